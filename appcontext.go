@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -29,6 +33,46 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// Action is either the name of a built-in action, written as a JSON string,
+// or a command line, written as an array.
+type Action struct {
+	Name    string
+	Command []string
+}
+
+func (a Action) MarshalJSON() ([]byte, error) {
+	if len(a.Command) > 0 {
+		return json.Marshal(a.Command)
+	}
+	return json.Marshal(a.Name)
+}
+
+func (a *Action) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &a.Name); err == nil {
+		return nil
+	}
+	var command []string
+	if err := json.Unmarshal(b, &command); err != nil {
+		return fmt.Errorf("action must be a name or a command array")
+	}
+	if len(command) == 0 {
+		return fmt.Errorf("action command must not be empty")
+	}
+	a.Command = command
+	return nil
+}
+
+func (a Action) IsSet() bool {
+	return a.Name != "" || len(a.Command) > 0
+}
+
+func (a Action) String() string {
+	if len(a.Command) > 0 {
+		return strings.Join(a.Command, " ")
+	}
+	return a.Name
+}
+
 type Config struct {
 	BacklightCurveFactor       float64  `json:"backlight_curve_factor"`
 	BacklightDimRatio          float64  `json:"backlight_dim_ratio"`
@@ -42,124 +86,152 @@ type Config struct {
 	TimeoutIdleBacklightOff    Duration `json:"timeout_idle_backlight_off"`
 	TimeoutIdleToSuspend       Duration `json:"timeout_idle_to_suspend"`
 	SuspendCommand             []string `json:"suspend_command"`
-	TrustedWifis               []string `json:"trusted_wifi_networks"`
-
-	path string
-}
-
-func (c *Config) RemoveCurrentWifi() {
-	mac, err := ExtractMac()
-	if err != nil {
-		lg.Error(err.Error())
-		return
-	}
-	var newlist []string
-	for _, macAddress := range c.TrustedWifis {
-		if macAddress != mac {
-			newlist = append(newlist, macAddress)
-		}
-	}
-	c.TrustedWifis = newlist
-}
-
-func (c *Config) AddCurrentWifi() {
-	mac, err := ExtractMac()
-	if err != nil {
-		lg.Error(err.Error())
-		return
-	}
-	for _, macAddress := range c.TrustedWifis {
-		if macAddress == mac {
-			return
-		}
-	}
-	c.TrustedWifis = append(c.TrustedWifis, mac)
-	lg.Debug("successfully added wifi")
+	// TrustedWifis is only read to migrate configs from before the state
+	// file, see LoadRuntimeState.
+	TrustedWifis []string `json:"trusted_wifi_networks"`
+
+	BatteryLowPercent        int                `json:"battery_low_percent"`
+	BatteryCriticalPercent   int                `json:"battery_critical_percent"`
+	BatteryCriticalAction    Action             `json:"battery_critical_action"`
+	Profiles                 map[string]Profile `json:"profiles"`
+	SleepMode                string             `json:"sleep_mode"`
+	HibernateAfter           Duration           `json:"hibernate_after"`
+	CaffeineNotify           bool               `json:"caffeine_notify"`
+	Timeline                 *Timeline          `json:"timeline"`
+	Hooks                    Hooks              `json:"hooks"`
+	IgnoreInhibitors         []string           `json:"ignore_inhibitors"`
+	MediaInhibit             bool               `json:"media_inhibit"`
+	MediaAudioInhibit        string             `json:"media_audio_inhibit"`
+	MediaPlayers             []string           `json:"media_players"`
+	MediaIgnorePlayers       []string           `json:"media_ignore_players"`
+	MediaVideoPlayers        []string           `json:"media_video_players"`
+	MediaResumeOnUnlock      bool               `json:"media_resume_on_unlock"`
+	MediaResumePlayers       []string           `json:"media_resume_players"`
+	MediaResumeIgnorePlayers []string           `json:"media_resume_ignore_players"`
+
+	path    string
+	keyPos  map[string]filePos
+	profile string
 }
 
 func loadConfigFromFile(configPath string) (*Config, error) {
-	_, err := os.Stat(configPath)
-	if err != nil {
-		lg.Error("file does not exist", "error", err.Error())
-		return nil, err
-	}
-	var config Config
-	jsonFile, err := os.Open(configPath)
+	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, err
 	}
-	defer jsonFile.Close()
+	return decodeConfig(configPath, data)
+}
 
-	byteValue, err := io.ReadAll(jsonFile)
+// loadConfig reads, completes and validates the config at configPath. A
+// broken file is reported rather than replaced, so neither startup nor a
+// reload can clobber it.
+func loadConfig(configPath string) (*Config, error) {
+	config, err := loadConfigFromFile(configPath)
 	if err != nil {
 		return nil, err
 	}
-
-	err = json.Unmarshal(byteValue, &config)
-	if err != nil {
+	config.applyDefaults()
+	if err := config.Validate(); err != nil {
 		return nil, err
 	}
-
-	config.path = configPath
-	return &config, nil
+	return config, nil
 }
 
-func initConfig(configPath string) *Config {
-	config, err := loadConfigFromFile(configPath)
-	if err != nil {
-		lg.Info("Failed to load config, creating a new one")
-		config = &Config{
+func initConfig(configPath string) (*Config, error) {
+	if _, err := os.Stat(configPath); errors.Is(err, fs.ErrNotExist) {
+		lg.Info("No config found, using defaults", "path", configPath)
+		config := &Config{
 			IdleGraceDuration: Duration{Duration: 30 * time.Second},
-			TrustedWifis:      []string{},
 			IdleSeat:          "seat0",
 			path:              configPath,
 		}
+		config.applyDefaults()
+		return config, config.Validate()
 	}
+	return loadConfig(configPath)
+}
 
+// timeoutKeys are the timeouts that can be listed in ignore_inhibitors.
+var timeoutKeys = []string{
+	"timeout_active_dim",
+	"timeout_active_to_idle",
+	"timeout_idle_backlight_off",
+	"timeout_idle_to_suspend",
+}
+
+// ignoresInhibitors reports whether the timeout key should fire on input
+// idleness alone, ignoring Wayland idle inhibitors.
+func (c *Config) ignoresInhibitors(key string) bool {
+	return slices.Contains(c.IgnoreInhibitors, key)
+}
+
+func (c *Config) applyDefaults() {
 	// Set default values if not specified in the loaded config
-	if config.BacklightCurveFactor == 0 {
-		config.BacklightCurveFactor = 0.5
+	if c.BacklightCurveFactor == 0 {
+		c.BacklightCurveFactor = 0.5
 	}
 
-	if config.BacklightDimRatio == 0 {
-		config.BacklightDimRatio = 0.2
+	if c.BacklightDimRatio == 0 {
+		c.BacklightDimRatio = 0.2
 	}
 
-	if config.BacklightSteps == 0 {
-		config.BacklightSteps = 16
+	if c.BacklightSteps == 0 {
+		c.BacklightSteps = 16
 	}
 
-	if config.TimeoutActiveDim.Duration == 0 {
-		config.TimeoutActiveDim = Duration{Duration: 150 * time.Second}
+	if c.TimeoutActiveDim.Duration == 0 {
+		c.TimeoutActiveDim = Duration{Duration: 150 * time.Second}
 		lg.Info("timeout_active_dim not set, using 150s")
 	}
 
-	if config.TimeoutActiveToIdle.Duration == 0 {
-		config.TimeoutActiveToIdle = Duration{Duration: config.TimeoutActiveDim.Duration + 30*time.Second}
+	if c.TimeoutActiveToIdle.Duration == 0 {
+		c.TimeoutActiveToIdle = Duration{Duration: c.TimeoutActiveDim.Duration + 30*time.Second}
 		lg.Info("timeout_active_to_idle not set, using timeout_active_dim + 30s",
-			"value", config.TimeoutActiveToIdle.Duration.String())
+			"value", c.TimeoutActiveToIdle.Duration.String())
 	}
 
-	if config.TimeoutIdleBacklightOff.Duration == 0 {
-		config.TimeoutIdleBacklightOff = Duration{Duration: 15 * time.Second}
+	if c.TimeoutIdleBacklightOff.Duration == 0 {
+		c.TimeoutIdleBacklightOff = Duration{Duration: 15 * time.Second}
 		lg.Info("timeout_idle_backlight_off not set, using 15s")
 	}
 
-	if config.TimeoutIdleToSuspend.Duration == 0 {
-		config.TimeoutIdleToSuspend = Duration{Duration: config.TimeoutIdleBacklightOff.Duration + 5*time.Second}
+	if c.TimeoutIdleToSuspend.Duration == 0 {
+		c.TimeoutIdleToSuspend = Duration{Duration: c.TimeoutIdleBacklightOff.Duration + 5*time.Second}
 		lg.Info("timeout_idle_to_suspend not set, using timeout_idle_backlight_off + 5s",
-			"value", config.TimeoutIdleToSuspend.Duration.String())
+			"value", c.TimeoutIdleToSuspend.Duration.String())
+	}
+
+	if len(c.LockCommand) == 0 {
+		c.LockCommand = getDefaultLockCommand()
+	}
+
+	if c.LockInitIgnoreInputTimeout.Duration == 0 {
+		c.LockInitIgnoreInputTimeout = Duration{Duration: 1 * time.Second}
 	}
 
-	if len(config.LockCommand) == 0 {
-		config.LockCommand = getDefaultLockCommand()
+	if c.BatteryLowPercent == 0 {
+		c.BatteryLowPercent = 20
 	}
 
-	if config.LockInitIgnoreInputTimeout.Duration == 0 {
-		config.LockInitIgnoreInputTimeout = Duration{Duration: 1 * time.Second}
+	if c.SleepMode == "" {
+		c.SleepMode = SleepModeSuspend
 	}
 
-	return config
+	if c.HibernateAfter.Duration == 0 {
+		c.HibernateAfter = Duration{Duration: 2 * time.Hour}
+	}
+
+	if c.BatteryCriticalPercent == 0 {
+		c.BatteryCriticalPercent = 5
+	}
+
+	if c.MediaAudioInhibit == "" {
+		c.MediaAudioInhibit = MediaAudioLock
+	}
+
+	if c.MediaVideoPlayers == nil {
+		c.MediaVideoPlayers = defaultVideoPlayers
+	}
 }
 
 func getDefaultLockCommand() []string {
@@ -172,26 +244,5 @@ func getDefaultLockCommand() []string {
 	if _, err := exec.LookPath("waylock"); err == nil {
 		return []string{"waylock"}
 	}
-	panic("No screenlocker found, not starting")
-}
-
-func (c *Config) Dump() {
-	lg.Debug("dumping config to disk")
-	jsonData, err := json.MarshalIndent(c, "", "    ")
-	if err != nil {
-		lg.Error(err.Error())
-		return
-	}
-	file, err := os.Create(c.path)
-	if err != nil {
-		lg.Error(err.Error())
-		return
-	}
-	defer file.Close()
-	_, err = file.Write(jsonData)
-	if err != nil {
-		lg.Error(err.Error())
-		return
-	}
-	lg.Debug("wrote config")
+	return nil
 }
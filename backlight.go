@@ -14,17 +14,21 @@ import (
 const backlightPath = "/sys/class/backlight"
 
 type Backlight struct {
-	curveFactor    float64
+	config         *SafeState[*Config]
 	device         string
 	maxBright      int
 	savedBright    int
 	hasSaved       bool
 	brightnessPath string
-	steps          int
-	dimRatio       float64
+	send           func(BackLight)
+	// onChange is called when a command changed the brightness
+	onChange   func(brightness, max int)
+	lastBright int
 }
 
-func NewBacklight(config *Config) (func(BackLight), error) {
+// NewBacklight reads the curve, step and dim settings from config on every
+// command, so a reloaded config takes effect without losing a saved dim level.
+func NewBacklight(config *SafeState[*Config], onChange func(brightness, max int)) (*Backlight, error) {
 	devices, err := os.ReadDir(backlightPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read backlight devices: %v", err)
@@ -37,9 +41,9 @@ func NewBacklight(config *Config) (func(BackLight), error) {
 	b := &Backlight{
 		device:         devices[0].Name(),
 		brightnessPath: filepath.Join(backlightPath, devices[0].Name(), "brightness"),
-		curveFactor:    config.BacklightCurveFactor,
-		steps:          config.BacklightSteps,
-		dimRatio:       config.BacklightDimRatio,
+		config:         config,
+		onChange:       onChange,
+		lastBright:     -1,
 	}
 
 	maxBrightness, err := os.ReadFile(filepath.Join(backlightPath, b.device, "max_brightness"))
@@ -55,8 +59,27 @@ func NewBacklight(config *Config) (func(BackLight), error) {
 
 	go b.controlLoop(controlChan)
 
-	sendNonBlockingMessage := utilities.CreateNonBlockingSender(controlChan)
-	return sendNonBlockingMessage, nil
+	b.send = utilities.CreateNonBlockingSender(controlChan)
+	return b, nil
+}
+
+// Control queues a command, replacing one that is still waiting.
+func (b *Backlight) Control(command BackLight) {
+	b.send(command)
+}
+
+// Brightness returns the current brightness, or 0 if it cannot be read.
+func (b *Backlight) Brightness() int {
+	current, err := b.getCurrentBrightness()
+	if err != nil {
+		lg.Error("Error getting current brightness:", "", err)
+		return 0
+	}
+	return current
+}
+
+func (b *Backlight) MaxBrightness() int {
+	return b.maxBright
 }
 
 func (b *Backlight) controlLoop(controlChan <-chan BackLight) {
@@ -71,6 +94,10 @@ func (b *Backlight) controlLoop(controlChan <-chan BackLight) {
 		case Restore:
 			b.restore()
 		}
+		if current, err := b.getCurrentBrightness(); err == nil && current != b.lastBright {
+			b.lastBright = current
+			b.onChange(current, b.maxBright)
+		}
 	}
 }
 
@@ -130,7 +157,8 @@ func (b *Backlight) increase() {
 		return
 	}
 
-	steps := calculateSteps(b.maxBright, b.steps, b.curveFactor)
+	config := b.config.Get()
+	steps := calculateSteps(b.maxBright, config.BacklightSteps, config.BacklightCurveFactor)
 
 	for _, step := range steps {
 		if step > current {
@@ -150,7 +178,8 @@ func (b *Backlight) decrease() {
 		return
 	}
 
-	steps := calculateSteps(b.maxBright, b.steps, b.curveFactor)
+	config := b.config.Get()
+	steps := calculateSteps(b.maxBright, config.BacklightSteps, config.BacklightCurveFactor)
 
 	for i := len(steps) - 1; i >= 0; i-- {
 		if steps[i] < current {
@@ -173,7 +202,7 @@ func (b *Backlight) dim() {
 	b.savedBright = current
 	b.hasSaved = true
 
-	newBrightness := int(float64(current) * b.dimRatio)
+	newBrightness := int(float64(current) * b.config.Get().BacklightDimRatio)
 	if newBrightness < 1 {
 		newBrightness = 1
 	}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/trbjo/goidle/power"
+)
+
+var batteryCriticalActions = []string{SleepModeHibernate, SleepModeHybridSleep, "poweroff"}
+
+// CreateBatteryCriticalFunc returns the function run when the battery drops
+// to battery_critical_percent, or nil when no action is configured.
+func CreateBatteryCriticalFunc(lidClosedChecker func() bool, action Action) func() bool {
+	if len(action.Command) > 0 {
+		return func() bool {
+			lg.Info("Running battery critical command", "command", action.String())
+			if err := exec.Command(action.Command[0], action.Command[1:]...).Run(); err != nil {
+				lg.Error("Battery critical command failed", "error", err.Error())
+				return false
+			}
+			return true
+		}
+	}
+
+	switch action.Name {
+	case SleepModeHibernate:
+		return CreateSystemdSleepFunc(lidClosedChecker, "Hibernate")
+	case SleepModeHybridSleep:
+		return CreateSystemdSleepFunc(lidClosedChecker, "HybridSleep")
+	case "poweroff":
+		return CreateSystemdPowerOffFunc()
+	default:
+		return nil
+	}
+}
+
+// batteryCriticalResumes reports whether the system comes back from the
+// battery critical action. Commands are assumed not to.
+func batteryCriticalResumes(action Action) bool {
+	return len(action.Command) == 0 && (action.Name == SleepModeHibernate || action.Name == SleepModeHybridSleep)
+}
+
+// CreateBatteryMonitor returns a function to be fed every power status. It
+// warns once when the battery falls to battery_low_percent and calls critical
+// once when it falls to battery_critical_percent. Both are rearmed when the
+// charger is plugged in.
+func CreateBatteryMonitor(config *SafeState[*Config], critical func()) func(power.Status) {
+	warned := false
+	triggered := false
+
+	return func(status power.Status) {
+		if !status.OnBattery || status.Capacity < 0 {
+			warned = false
+			triggered = false
+			return
+		}
+
+		cfg := config.Get()
+		if status.Capacity <= cfg.BatteryCriticalPercent && cfg.BatteryCriticalAction.IsSet() {
+			if !triggered {
+				triggered = true
+				lg.Warn("Battery critical", "capacity", status.Capacity, "action", cfg.BatteryCriticalAction.String())
+				critical()
+			}
+			return
+		}
+
+		if status.Capacity <= cfg.BatteryLowPercent && !warned {
+			warned = true
+			lg.Warn("Battery low", "capacity", status.Capacity)
+			SendNotification(Notification{
+				Icon:          "battery-caution",
+				Summary:       "Battery low",
+				Body:          fmt.Sprintf("%d%% remaining", status.Capacity),
+				ExpireTimeout: 0,
+				Urgency:       UrgencyCritical,
+			})
+		}
+	}
+}
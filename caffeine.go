@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/trbjo/goidle/dbusapi"
+)
+
+// caffeineOwner is the registry owner of the caffeine inhibitor. It is not a
+// bus name, so the inhibitor is never released by IdleAllow or by a client
+// disconnecting.
+const caffeineOwner = "goidle:caffeine"
+
+// Caffeine inhibits idle until a deadline. The deadline is kept in the
+// runtime state so it survives a restart.
+type Caffeine struct {
+	mu         sync.Mutex
+	inhibitors *InhibitorRegistry
+	state      *RuntimeState
+	config     *SafeState[*Config]
+	deadline   time.Time
+	cookie     uint32
+	timer      *time.Timer
+	onChange   func()
+}
+
+func NewCaffeine(inhibitors *InhibitorRegistry, state *RuntimeState, config *SafeState[*Config]) *Caffeine {
+	c := &Caffeine{
+		inhibitors: inhibitors,
+		state:      state,
+		config:     config,
+		onChange:   func() {},
+	}
+	if deadline := state.CaffeineDeadline(); !deadline.IsZero() {
+		if time.Until(deadline) > 0 {
+			lg.Info("Resuming caffeine", "until", deadline.Format(time.TimeOnly))
+		}
+		c.Set(deadline)
+	}
+	return c
+}
+
+// OnChange sets the function called whenever the deadline changes.
+func (c *Caffeine) OnChange(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = fn
+}
+
+func (c *Caffeine) Deadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline
+}
+
+func (c *Caffeine) Remaining() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.deadline.IsZero() {
+		return 0
+	}
+	return max(time.Until(c.deadline), 0).Round(time.Second)
+}
+
+// Set inhibits idle until deadline, replacing any previous deadline. A zero
+// or past deadline cancels caffeine.
+func (c *Caffeine) Set(deadline time.Time) {
+	c.mu.Lock()
+	c.set(deadline)
+}
+
+// set replaces the deadline. It is called with c.mu held and releases it.
+func (c *Caffeine) set(deadline time.Time) {
+	if !deadline.IsZero() && time.Until(deadline) <= 0 {
+		deadline = time.Time{}
+	}
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	// add the new inhibitor before releasing the old one so idle is not
+	// briefly allowed when extending
+	old := c.cookie
+	c.cookie = 0
+	if !deadline.IsZero() {
+		reason := "caffeine until " + deadline.Format(time.TimeOnly)
+		c.cookie = c.inhibitors.Add(caffeineOwner, "goidle", reason, 0)
+		c.timer = time.AfterFunc(time.Until(deadline), func() { c.expire(deadline) })
+	}
+	if old != 0 {
+		c.inhibitors.Remove(old)
+	}
+	c.deadline = deadline
+	onChange := c.onChange
+	c.mu.Unlock()
+
+	if err := c.state.SetCaffeineDeadline(deadline); err != nil {
+		lg.Error("Failed to save state", "error", err.Error())
+	}
+	onChange()
+}
+
+// expire cancels caffeine unless the deadline the timer was armed for was
+// replaced while the timer fired.
+func (c *Caffeine) expire(deadline time.Time) {
+	c.mu.Lock()
+	if !c.deadline.Equal(deadline) {
+		c.mu.Unlock()
+		return
+	}
+	lg.Info("Caffeine expired")
+	c.set(time.Time{})
+	if c.config.Get().CaffeineNotify {
+		SendNotification(Notification{
+			Icon:          "preferences-desktop-screensaver",
+			Summary:       "Caffeine expired",
+			Body:          "The screen will lock when idle again",
+			ExpireTimeout: 5000,
+			Urgency:       UrgencyNormal,
+		})
+	}
+}
+
+// parseCaffeine turns the argument of Caffeinate into a deadline. A duration
+// sets the deadline from now, a duration prefixed with + extends the current
+// deadline and "cancel" or "0" cancels.
+func parseCaffeine(arg string, current time.Time, now time.Time) (time.Time, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "cancel" || arg == "0" {
+		return time.Time{}, nil
+	}
+
+	extend := strings.HasPrefix(arg, "+")
+	d, err := time.ParseDuration(strings.TrimPrefix(arg, "+"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid caffeine duration %q, expected e.g. 45m, +15m or cancel", arg)
+	}
+	if d <= 0 {
+		return time.Time{}, fmt.Errorf("caffeine duration must be positive, got %s", arg)
+	}
+
+	if extend && current.After(now) {
+		return current.Add(d), nil
+	}
+	return now.Add(d), nil
+}
+
+// runCaffeinate implements the caffeinate subcommand by calling Caffeinate on
+// the running daemon and returns the process exit code.
+func runCaffeinate(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: goidle caffeinate DURATION|+DURATION|cancel")
+		return 2
+	}
+
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect to session bus:", err)
+		return 1
+	}
+	var remaining uint32
+	obj := conn.Object(dbusapi.BusName, dbusPath)
+	if err := obj.Call(dbusInterface+".Caffeinate", 0, args[0]).Store(&remaining); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if remaining == 0 {
+		fmt.Println("caffeine cancelled")
+	} else {
+		d := time.Duration(remaining) * time.Second
+		fmt.Printf("caffeinated for %s, until %s\n", d, time.Now().Add(d).Format(time.TimeOnly))
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCaffeine(t *testing.T) (*Caffeine, *InhibitorRegistry, *RuntimeState) {
+	config := &Config{}
+	state := LoadRuntimeState(filepath.Join(t.TempDir(), "state.json"), config)
+	inhibitors := NewInhibitorRegistry(func(bool) {})
+	c := NewCaffeine(inhibitors, state, NewSafeState(config))
+	t.Cleanup(func() { c.Set(time.Time{}) })
+	return c, inhibitors, state
+}
+
+func TestCaffeineExpires(t *testing.T) {
+	c, inhibitors, state := newTestCaffeine(t)
+	c.Set(time.Now().Add(20 * time.Millisecond))
+	if !inhibitors.Inhibited() {
+		t.Fatal("caffeine does not inhibit idle")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !c.Deadline().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("caffeine did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if inhibitors.Inhibited() || !state.CaffeineDeadline().IsZero() {
+		t.Error("expired caffeine left its inhibitor or deadline behind")
+	}
+}
+
+func TestCaffeineExtendedAsItExpires(t *testing.T) {
+	c, inhibitors, state := newTestCaffeine(t)
+	first := time.Now().Add(time.Hour)
+	c.Set(first)
+	second := first.Add(30 * time.Minute)
+	c.Set(second)
+	// the timer of the first deadline fired while Set held the lock
+	c.expire(first)
+
+	if !c.Deadline().Equal(second) {
+		t.Errorf("deadline %s, want %s", c.Deadline(), second)
+	}
+	if !state.CaffeineDeadline().Equal(second) {
+		t.Errorf("saved deadline %s, want %s", state.CaffeineDeadline(), second)
+	}
+	if list := inhibitors.List(); len(list) != 1 {
+		t.Errorf("%d inhibitors, want the one of the new deadline", len(list))
+	}
+
+	c.expire(second)
+	if !c.Deadline().IsZero() || inhibitors.Inhibited() {
+		t.Error("caffeine did not expire at the new deadline")
+	}
+}
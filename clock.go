@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Clock is the time source of the state machine and the locker, so tests can
+// control time.
+type Clock interface {
+	// SinceBoot returns the time since boot, including time spent suspended.
+	SinceBoot() time.Duration
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) SinceBoot() time.Duration {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		lg.Error("Error getting current CLOCK_BOOTTIME", "error", err.Error())
+		os.Exit(128)
+	}
+	return time.Duration(ts.Nano())
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/trbjo/goidle/dbusapi"
+)
+
+type command struct {
+	words []string
+	// usage describes the arguments
+	usage string
+	// nargs is the number of arguments, -1 for any
+	nargs int
+	help  string
+	// outputs completes the argument with the names of the connected outputs
+	outputs bool
+	run     func(bus Bus, args []string) (any, error)
+}
+
+func (c command) name() string {
+	return strings.Join(c.words, " ")
+}
+
+// groups describes the commands that only exist with a subcommand.
+var groups = map[string]string{
+	"completion": "print a shell completion script",
+	"lid":        "report lid events",
+	"light":      "change the screen brightness",
+	"log":        "set the log level",
+	"output":     "list and toggle outputs",
+	"wifi":       "manage trusted networks",
+}
+
+var commands = []command{
+	{words: []string{"lock"}, help: "lock the screen", run: void("Lock")},
+	{words: []string{"suspend"}, help: "lock and suspend", run: void("Suspend")},
+	{words: []string{"hibernate"}, help: "lock and hibernate", run: void("Hibernate")},
+	{words: []string{"hybrid-sleep"}, help: "lock and suspend to both RAM and disk", run: void("HybridSleep")},
+	{words: []string{"lid", "close"}, help: "report that the lid was closed", run: void("LidClose")},
+	{words: []string{"lid", "open"}, help: "report that the lid was opened", run: void("LidOpen")},
+	{words: []string{"wifi", "trust"}, help: "trust the current WiFi network", run: wifi("WifiTrust")},
+	{words: []string{"wifi", "distrust"}, help: "stop trusting the current WiFi network", run: wifi("WifiDistrust")},
+	{words: []string{"grace"}, usage: "DURATION", nargs: 1, help: "set the idle grace duration", run: void("IdleGraceDuration")},
+	{words: []string{"inhibit"}, usage: "[--for DURATION] [REASON...]", nargs: -1, help: "inhibit idle until interrupted or for a duration", run: inhibit},
+	{words: []string{"release"}, usage: "COOKIE", nargs: 1, help: "release an inhibitor", run: release},
+	{words: []string{"allow"}, help: "release the inhibitors taken with inhibit --for", run: void("IdleAllow")},
+	{words: []string{"inhibitors"}, help: "list the inhibitors", run: listInhibitors},
+	{words: []string{"caffeinate"}, usage: "DURATION|+DURATION|cancel", nargs: 1, help: "inhibit idle for a while", run: caffeinate},
+	{words: []string{"light", "up"}, help: "increase the brightness", run: void("LightIncrease")},
+	{words: []string{"light", "down"}, help: "decrease the brightness", run: void("LightDecrease")},
+	{words: []string{"output", "list"}, help: "list the connected outputs", run: listOutputs},
+	{words: []string{"output", "toggle"}, usage: "NAME", nargs: 1, help: "turn an output on or off", outputs: true, run: toggleOutput},
+	{words: []string{"log", "debug"}, help: "log debug messages", run: void("LogDebug")},
+	{words: []string{"log", "info"}, help: "log info messages", run: void("LogInfo")},
+	{words: []string{"log", "warn"}, help: "log warnings only", run: void("LogWarn")},
+	{words: []string{"reload"}, help: "reload the config file", run: void("Reload")},
+	{words: []string{"completion", "bash"}, help: "print the bash completion script"},
+	{words: []string{"completion", "zsh"}, help: "print the zsh completion script"},
+	{words: []string{"completion", "fish"}, help: "print the fish completion script"},
+}
+
+// lookup finds the command named by the leading args and returns it with the
+// remaining args.
+func lookup(args []string) (command, []string, bool) {
+	for _, cmd := range commands {
+		if len(args) < len(cmd.words) {
+			continue
+		}
+		if strings.Join(args[:len(cmd.words)], " ") == cmd.name() {
+			return cmd, args[len(cmd.words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: goidlectl [--json] COMMAND [ARGS]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name(), cmd.usage, cmd.help)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "exit status is 1 when goidle returns an error, 2 on usage errors and 3")
+	fmt.Fprintln(w, "when goidle is not running.")
+}
+
+// void calls a method that returns nothing, passing the arguments as strings.
+func void(method string) func(Bus, []string) (any, error) {
+	return func(bus Bus, args []string) (any, error) {
+		callArgs := make([]any, len(args))
+		for i, arg := range args {
+			callArgs[i] = arg
+		}
+		return nil, bus.Call(method, callArgs...).Err
+	}
+}
+
+type cookie struct {
+	Cookie uint32 `json:"cookie"`
+}
+
+func (c cookie) String() string {
+	return strconv.FormatUint(uint64(c.Cookie), 10)
+}
+
+// waitForSignal blocks until goidlectl is interrupted.
+var waitForSignal = func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	<-signals
+}
+
+// inhibit takes an inhibitor for a duration, or holds one tied to the
+// connection until interrupted.
+func inhibit(bus Bus, args []string) (any, error) {
+	flags := flag.NewFlagSet("inhibit", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	duration := flags.String("for", "", "")
+	if err := flags.Parse(args); err != nil {
+		return nil, usageError{err}
+	}
+	reason := strings.Join(flags.Args(), " ")
+	if reason == "" {
+		reason = "goidlectl"
+	}
+
+	var c cookie
+	if *duration != "" {
+		err := bus.Call("IdleInhibitFor", *duration, reason).Store(&c.Cookie)
+		return c, err
+	}
+	if err := bus.Call("IdleInhibit", reason).Store(&c.Cookie); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "inhibiting idle with cookie %d until interrupted\n", c.Cookie)
+	waitForSignal()
+	return nil, bus.Call("IdleRelease", c.Cookie).Err
+}
+
+func release(bus Bus, args []string) (any, error) {
+	c, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return nil, usageError{fmt.Errorf("invalid cookie %q", args[0])}
+	}
+	return nil, bus.Call("IdleRelease", uint32(c)).Err
+}
+
+type inhibitorList []dbusapi.InhibitorInfo
+
+func (l inhibitorList) String() string {
+	if len(l) == 0 {
+		return "no inhibitors"
+	}
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COOKIE\tKIND\tAPP\tREASON\tSINCE\tEXPIRES")
+	for _, i := range l {
+		expires := "-"
+		if i.Expires != 0 {
+			expires = time.Unix(i.Expires, 0).Format(time.TimeOnly)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", i.Cookie, i.Kind, i.App, i.Reason,
+			time.Unix(i.Since, 0).Format(time.TimeOnly), expires)
+	}
+	tw.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func listInhibitors(bus Bus, args []string) (any, error) {
+	list := inhibitorList{}
+	err := bus.Call("ListInhibitors").Store((*[]dbusapi.InhibitorInfo)(&list))
+	return list, err
+}
+
+type caffeine struct {
+	Remaining uint32 `json:"remaining"`
+}
+
+func (c caffeine) String() string {
+	if c.Remaining == 0 {
+		return "caffeine cancelled"
+	}
+	d := time.Duration(c.Remaining) * time.Second
+	return fmt.Sprintf("caffeinated for %s, until %s", d, time.Now().Add(d).Format(time.TimeOnly))
+}
+
+func caffeinate(bus Bus, args []string) (any, error) {
+	var c caffeine
+	err := bus.Call("Caffeinate", args[0]).Store(&c.Remaining)
+	return c, err
+}
+
+type outputList []string
+
+func (l outputList) String() string {
+	return strings.Join(l, "\n")
+}
+
+func listOutputs(bus Bus, args []string) (any, error) {
+	list := outputList{}
+	err := bus.Call("ListOutputs").Store((*[]string)(&list))
+	return list, err
+}
+
+type network struct {
+	MAC string `json:"mac"`
+}
+
+func (n network) String() string {
+	return n.MAC
+}
+
+// wifi calls a method that returns the MAC address of the current network.
+func wifi(method string) func(Bus, []string) (any, error) {
+	return func(bus Bus, args []string) (any, error) {
+		var n network
+		err := bus.Call(method).Store(&n.MAC)
+		return n, err
+	}
+}
+
+type outputMode struct {
+	Output string `json:"output"`
+	Mode   string `json:"mode"`
+}
+
+func (m outputMode) String() string {
+	return m.Output + " " + m.Mode
+}
+
+func toggleOutput(bus Bus, args []string) (any, error) {
+	m := outputMode{Output: args[0]}
+	err := bus.Call("ToggleOutput", args[0]).Store(&m.Mode)
+	return m, err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// candidate is a word that can be completed after the words in prefix.
+type candidate struct {
+	prefix string
+	word   string
+	help   string
+}
+
+// candidates lists the words of every command in the order of the command
+// table, the names of groups only once.
+func candidates() []candidate {
+	var list []candidate
+	seen := make(map[string]bool)
+	for _, cmd := range commands {
+		for i, word := range cmd.words {
+			prefix := strings.Join(cmd.words[:i], " ")
+			key := prefix + " " + word
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			help := cmd.help
+			if i < len(cmd.words)-1 {
+				help = groups[word]
+			}
+			list = append(list, candidate{prefix: prefix, word: word, help: help})
+		}
+	}
+	return list
+}
+
+// prefixes returns the prefixes of the candidates in order and the prefixes
+// of the commands completing output names.
+func prefixes(list []candidate) ([]string, []string) {
+	var ordered []string
+	seen := make(map[string]bool)
+	for _, c := range list {
+		if !seen[c.prefix] {
+			seen[c.prefix] = true
+			ordered = append(ordered, c.prefix)
+		}
+	}
+	var outputs []string
+	for _, cmd := range commands {
+		if cmd.outputs {
+			outputs = append(outputs, cmd.name())
+		}
+	}
+	return ordered, outputs
+}
+
+const listOutputsCommand = "goidlectl output list 2>/dev/null"
+
+func completion(shell string) string {
+	switch shell {
+	case "bash":
+		return bashCompletion()
+	case "zsh":
+		return zshCompletion()
+	case "fish":
+		return fishCompletion()
+	}
+	return ""
+}
+
+func bashCompletion() string {
+	list := candidates()
+	ordered, outputs := prefixes(list)
+	var b strings.Builder
+	b.WriteString(`# bash completion for goidlectl, generated by goidlectl completion bash
+_goidlectl() {
+	local cur=${COMP_WORDS[COMP_CWORD]} words=() word candidates
+	for word in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+		[[ $word == -* ]] || words+=("$word")
+	done
+	case "${words[*]}" in
+`)
+	for _, prefix := range ordered {
+		var words []string
+		if prefix == "" {
+			words = append(words, "--json")
+		}
+		for _, c := range list {
+			if c.prefix == prefix {
+				words = append(words, c.word)
+			}
+		}
+		fmt.Fprintf(&b, "\t%q) candidates=%q ;;\n", prefix, strings.Join(words, " "))
+	}
+	for _, prefix := range outputs {
+		fmt.Fprintf(&b, "\t%q) candidates=$(%s) ;;\n", prefix, listOutputsCommand)
+	}
+	b.WriteString(`	*) return ;;
+	esac
+	COMPREPLY=($(compgen -W "$candidates" -- "$cur"))
+}
+complete -F _goidlectl goidlectl
+`)
+	return b.String()
+}
+
+func zshCompletion() string {
+	list := candidates()
+	ordered, outputs := prefixes(list)
+	var b strings.Builder
+	b.WriteString(`#compdef goidlectl
+# zsh completion for goidlectl, generated by goidlectl completion zsh
+
+_goidlectl() {
+	local -a args commands
+	args=(${${words[2,CURRENT-1]}:#-*})
+	case "${args[*]}" in
+`)
+	for _, prefix := range ordered {
+		fmt.Fprintf(&b, "\t%q)\n\t\tcommands=(\n", prefix)
+		for _, c := range list {
+			if c.prefix == prefix {
+				fmt.Fprintf(&b, "\t\t\t%s\n", shellQuote(c.word+":"+c.help))
+			}
+		}
+		b.WriteString("\t\t)\n\t\t_describe command commands\n")
+		if prefix == "" {
+			b.WriteString("\t\tcompadd -- --json\n")
+		}
+		b.WriteString("\t\t;;\n")
+	}
+	for _, prefix := range outputs {
+		fmt.Fprintf(&b, "\t%q)\n\t\tcompadd -- ${(f)\"$(%s)\"}\n\t\t;;\n", prefix, listOutputsCommand)
+	}
+	b.WriteString(`	esac
+}
+
+if [[ $funcstack[1] == _goidlectl ]]; then
+	_goidlectl "$@"
+else
+	compdef _goidlectl goidlectl
+fi
+`)
+	return b.String()
+}
+
+func fishCompletion() string {
+	list := candidates()
+	ordered, outputs := prefixes(list)
+	var b strings.Builder
+	b.WriteString(`# fish completion for goidlectl, generated by goidlectl completion fish
+complete -c goidlectl -f
+complete -c goidlectl -l json -d 'print JSON'
+`)
+	for _, prefix := range ordered {
+		var words []string
+		for _, c := range list {
+			if c.prefix == prefix {
+				words = append(words, c.word)
+			}
+		}
+		condition := "__fish_use_subcommand"
+		if prefix != "" {
+			condition = fishSeen(prefix) + "; and not __fish_seen_subcommand_from " + strings.Join(words, " ")
+		}
+		for _, c := range list {
+			if c.prefix == prefix {
+				fmt.Fprintf(&b, "complete -c goidlectl -n %s -a %s -d %s\n", shellQuote(condition), c.word, shellQuote(c.help))
+			}
+		}
+	}
+	for _, prefix := range outputs {
+		fmt.Fprintf(&b, "complete -c goidlectl -n %s -a %s\n", shellQuote(fishSeen(prefix)), shellQuote("("+listOutputsCommand+")"))
+	}
+	return b.String()
+}
+
+// fishSeen is a fish condition that holds when all words of prefix were given.
+func fishSeen(prefix string) string {
+	var conditions []string
+	for _, word := range strings.Fields(prefix) {
+		conditions = append(conditions, "__fish_seen_subcommand_from "+word)
+	}
+	return strings.Join(conditions, "; and ")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,151 @@
+// Command goidlectl controls a running goidle through its D-Bus API.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/trbjo/goidle/dbusapi"
+)
+
+const (
+	exitOK = 0
+	// exitFailed is returned when goidle returns an error
+	exitFailed     = 1
+	exitUsage      = 2
+	exitNotRunning = 3
+)
+
+// Bus calls the methods of the GoIdle interface.
+type Bus interface {
+	Call(method string, args ...any) *dbus.Call
+}
+
+type daemon struct {
+	obj dbus.BusObject
+}
+
+func (d daemon) Call(method string, args ...any) *dbus.Call {
+	return d.obj.Call(dbusapi.Interface+"."+method, dbus.FlagNoAutoStart, args...)
+}
+
+func connect() (Bus, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, err
+	}
+	return daemon{conn.Object(dbusapi.BusName, dbusapi.Path)}, nil
+}
+
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	return e.err.Error()
+}
+
+// errorName returns the D-Bus name of an error returned by goidle.
+func errorName(err error) (string, bool) {
+	var value dbus.Error
+	if errors.As(err, &value) {
+		return value.Name, true
+	}
+	var pointer *dbus.Error
+	if errors.As(err, &pointer) {
+		return pointer.Name, true
+	}
+	return "", false
+}
+
+func exitCode(err error) int {
+	if errors.As(err, &usageError{}) {
+		return exitUsage
+	}
+	name, ok := errorName(err)
+	if !ok {
+		return exitFailed
+	}
+	switch name {
+	case "org.freedesktop.DBus.Error.ServiceUnknown", "org.freedesktop.DBus.Error.NameHasNoOwner":
+		return exitNotRunning
+	}
+	return exitFailed
+}
+
+func run(args []string, stdout, stderr io.Writer, connect func() (Bus, error)) int {
+	flags := flag.NewFlagSet("goidlectl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { printUsage(stderr) }
+	asJSON := flags.Bool("json", false, "print JSON")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	cmd, cmdArgs, ok := lookup(flags.Args())
+	if !ok {
+		if flags.NArg() > 0 {
+			fmt.Fprintf(stderr, "goidlectl: unknown command %q\n", flags.Arg(0))
+		}
+		printUsage(stderr)
+		return exitUsage
+	}
+	if cmd.nargs >= 0 && len(cmdArgs) != cmd.nargs {
+		fmt.Fprintf(stderr, "usage: goidlectl %s %s\n", cmd.name(), cmd.usage)
+		return exitUsage
+	}
+	if cmd.words[0] == "completion" {
+		fmt.Fprint(stdout, completion(cmd.words[1]))
+		return exitOK
+	}
+
+	bus, err := connect()
+	if err != nil {
+		fmt.Fprintln(stderr, "goidlectl: cannot connect to the session bus:", err)
+		return exitNotRunning
+	}
+	result, err := cmd.run(bus, cmdArgs)
+	if err != nil {
+		code := exitCode(err)
+		if code == exitNotRunning {
+			fmt.Fprintln(stderr, "goidlectl: goidle is not running")
+		} else {
+			fmt.Fprintf(stderr, "goidlectl %s: %s\n", cmd.name(), err)
+		}
+		if *asJSON {
+			name, _ := errorName(err)
+			printJSON(stdout, map[string]string{"error": name, "message": err.Error()})
+		}
+		return code
+	}
+
+	if *asJSON {
+		if result == nil {
+			result = struct{}{}
+		}
+		printJSON(stdout, result)
+	} else if text := fmt.Sprint(result); result != nil && text != "" {
+		fmt.Fprintln(stdout, text)
+	}
+	return exitOK
+}
+
+func printJSON(w io.Writer, v any) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(w, string(out))
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr, connect))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/trbjo/goidle/dbusapi"
+)
+
+// fakeBus records the calls and answers them with body or err.
+type fakeBus struct {
+	calls []string
+	body  []any
+	err   error
+}
+
+func (b *fakeBus) Call(method string, args ...any) *dbus.Call {
+	call := method
+	for _, arg := range args {
+		call += fmt.Sprintf(" %v", arg)
+	}
+	b.calls = append(b.calls, call)
+	return &dbus.Call{Body: b.body, Err: b.err}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		body      []any
+		err       error
+		wantCalls []string
+		wantCode  int
+		wantOut   string
+	}{
+		{name: "lock", args: []string{"lock"}, wantCalls: []string{"Lock"}},
+		{name: "subcommand", args: []string{"lid", "close"}, wantCalls: []string{"LidClose"}},
+		{
+			name:      "argument",
+			args:      []string{"output", "toggle", "eDP-1"},
+			body:      []any{"off"},
+			wantCalls: []string{"ToggleOutput eDP-1"},
+			wantOut:   "eDP-1 off\n",
+		},
+		{
+			name:      "wifi",
+			args:      []string{"--json", "wifi", "trust"},
+			body:      []any{"aa:bb:cc:dd:ee:ff"},
+			wantCalls: []string{"WifiTrust"},
+			wantOut:   `{"mac":"aa:bb:cc:dd:ee:ff"}` + "\n",
+		},
+		{name: "json of void method", args: []string{"--json", "light", "up"}, wantCalls: []string{"LightIncrease"}, wantOut: "{}\n"},
+		{
+			name:      "inhibit for",
+			args:      []string{"inhibit", "--for", "45m", "watching", "a", "film"},
+			body:      []any{uint32(7)},
+			wantCalls: []string{"IdleInhibitFor 45m watching a film"},
+			wantOut:   "7\n",
+		},
+		{name: "release", args: []string{"release", "7"}, wantCalls: []string{"IdleRelease 7"}},
+		{name: "invalid cookie", args: []string{"release", "seven"}, wantCode: exitUsage},
+		{
+			name:      "json output",
+			args:      []string{"--json", "caffeinate", "cancel"},
+			body:      []any{uint32(0)},
+			wantCalls: []string{"Caffeinate cancel"},
+			wantOut:   `{"remaining":0}` + "\n",
+		},
+		{
+			name:      "inhibitors",
+			args:      []string{"--json", "inhibitors"},
+			body:      []any{[]dbusapi.InhibitorInfo{{Cookie: 1, Kind: "idle", App: "mpv", Reason: "video", Since: 10}}},
+			wantCalls: []string{"ListInhibitors"},
+			wantOut:   `[{"cookie":1,"kind":"idle","owner":"","app":"mpv","reason":"video","since":10,"expires":0}]` + "\n",
+		},
+		{
+			name:      "outputs",
+			args:      []string{"output", "list"},
+			body:      []any{[]string{"DP-1", "eDP-1"}},
+			wantCalls: []string{"ListOutputs"},
+			wantOut:   "DP-1\neDP-1\n",
+		},
+		{
+			name:      "daemon error",
+			args:      []string{"--json", "reload"},
+			err:       dbus.Error{Name: "org.freedesktop.DBus.Error.Failed", Body: []any{"invalid config"}},
+			wantCalls: []string{"Reload"},
+			wantCode:  exitFailed,
+			wantOut:   `{"error":"org.freedesktop.DBus.Error.Failed","message":"invalid config"}` + "\n",
+		},
+		{
+			name:      "typed error",
+			args:      []string{"output", "toggle", "HDMI-A-1"},
+			err:       dbus.Error{Name: dbusapi.ErrorNoSuchOutput, Body: []any{"no such output: HDMI-A-1"}},
+			wantCalls: []string{"ToggleOutput HDMI-A-1"},
+			wantCode:  exitFailed,
+		},
+		{
+			name:      "not running",
+			args:      []string{"suspend"},
+			err:       dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown"},
+			wantCalls: []string{"Suspend"},
+			wantCode:  exitNotRunning,
+		},
+		{name: "unknown command", args: []string{"sleep"}, wantCode: exitUsage},
+		{name: "missing argument", args: []string{"grace"}, wantCode: exitUsage},
+		{name: "extra argument", args: []string{"lock", "now"}, wantCode: exitUsage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := &fakeBus{body: tt.body, err: tt.err}
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, &stdout, &stderr, func() (Bus, error) { return bus, nil })
+			if code != tt.wantCode {
+				t.Errorf("exit code %d, want %d, stderr: %s", code, tt.wantCode, stderr.String())
+			}
+			if !reflect.DeepEqual(bus.calls, tt.wantCalls) {
+				t.Errorf("calls %q, want %q", bus.calls, tt.wantCalls)
+			}
+			if stdout.String() != tt.wantOut {
+				t.Errorf("output %q, want %q", stdout.String(), tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		var stdout bytes.Buffer
+		if code := run([]string{"completion", shell}, &stdout, &bytes.Buffer{}, nil); code != exitOK {
+			t.Fatalf("completion %s exited with %d", shell, code)
+		}
+		script := stdout.String()
+		for _, want := range []string{"hybrid-sleep", "distrust", "warn", listOutputsCommand} {
+			if !strings.Contains(script, want) {
+				t.Errorf("%s completion does not contain %q", shell, want)
+			}
+		}
+	}
+}
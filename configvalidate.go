@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+type filePos struct {
+	line   int
+	column int
+}
+
+// ConfigError describes a problem with a single setting in the config file.
+// Line and Column are 1-based and zero when the position is unknown.
+type ConfigError struct {
+	Path   string
+	Line   int
+	Column int
+	Key    string
+	Msg    string
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Path)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d:%d", e.Line, e.Column)
+	}
+	b.WriteString(": ")
+	if e.Key != "" {
+		fmt.Fprintf(&b, "%s: ", e.Key)
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+func offsetToPos(data []byte, offset int64) filePos {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return filePos{line: line, column: column}
+}
+
+// skipSeparators advances offset past whitespace and the separators that
+// json.Decoder leaves in front of the next token.
+func skipSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func configKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag != "" && tag != "-" {
+			keys[tag] = true
+		}
+	}
+	return keys
+}
+
+// decodeConfig parses data strictly: unknown keys, type mismatches and syntax
+// errors are all reported with the position of the offending key or token.
+// Each top-level key is decoded on its own so one bad value doesn't hide the
+// rest.
+func decodeConfig(path string, data []byte) (*Config, error) {
+	config := &Config{path: path, keyPos: make(map[string]filePos)}
+	known := configKeys()
+	var errs []error
+
+	syntaxError := func(err error) error {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// Offset is just past the offending character
+			pos := offsetToPos(data, max(syntaxErr.Offset-1, 0))
+			return &ConfigError{Path: path, Line: pos.line, Column: pos.column, Msg: syntaxErr.Error()}
+		}
+		return &ConfigError{Path: path, Msg: err.Error()}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, syntaxError(err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, &ConfigError{Path: path, Line: 1, Column: 1, Msg: "config must be a JSON object"}
+	}
+
+	for dec.More() {
+		keyOffset := skipSeparators(data, dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, syntaxError(err)
+		}
+		key := tok.(string)
+		pos := offsetToPos(data, keyOffset)
+		config.keyPos[key] = pos
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, syntaxError(err)
+		}
+
+		if !known[key] {
+			errs = append(errs, &ConfigError{Path: path, Line: pos.line, Column: pos.column, Key: key, Msg: "unknown key"})
+			continue
+		}
+
+		single, _ := json.Marshal(map[string]json.RawMessage{key: raw})
+		fieldDec := json.NewDecoder(bytes.NewReader(single))
+		fieldDec.DisallowUnknownFields()
+		if err := fieldDec.Decode(config); err != nil {
+			msg := err.Error()
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				msg = fmt.Sprintf("cannot use %s as %s", typeErr.Value, typeErr.Type)
+			}
+			errs = append(errs, &ConfigError{Path: path, Line: pos.line, Column: pos.column, Key: key, Msg: msg})
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, syntaxError(err)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return config, nil
+}
+
+// Validate checks the ranges and cross-field constraints of a config that
+// already had its defaults applied, including the config each profile
+// results in.
+func (c *Config) Validate() error {
+	var errs []error
+	failAt := func(posKey, key, format string, args ...any) {
+		pos := c.keyPos[posKey]
+		errs = append(errs, &ConfigError{
+			Path:   c.path,
+			Line:   pos.line,
+			Column: pos.column,
+			Key:    key,
+			Msg:    fmt.Sprintf(format, args...),
+		})
+	}
+	fail := func(key, format string, args ...any) {
+		// nested keys such as timeline.active[0].action are positioned at
+		// their top-level key
+		posKey, _, _ := strings.Cut(key, ".")
+		failAt(posKey, key, format, args...)
+	}
+
+	c.validateValues(fail)
+
+	if len(c.LockCommand) == 0 {
+		fail("lock_command", "not set and no screen locker (hyprlock, swaylock, waylock) found in PATH")
+	} else if _, err := exec.LookPath(c.LockCommand[0]); err != nil {
+		fail("lock_command", "%s not found in PATH", c.LockCommand[0])
+	}
+
+	if len(c.SuspendCommand) > 0 {
+		if _, err := exec.LookPath(c.SuspendCommand[0]); err != nil {
+			fail("suspend_command", "%s not found in PATH", c.SuspendCommand[0])
+		}
+	}
+
+	if c.BatteryLowPercent < 0 || c.BatteryLowPercent > 100 {
+		fail("battery_low_percent", "must be between 0 and 100, got %d", c.BatteryLowPercent)
+	}
+
+	if !slices.Contains(sleepModes, c.SleepMode) {
+		fail("sleep_mode", "unknown mode %q, must be one of %s", c.SleepMode, strings.Join(sleepModes, ", "))
+	}
+	if c.SleepMode == SleepModeSuspendThenHibernate && len(c.SuspendCommand) == 0 {
+		if err := checkSuspendThenHibernate(); err != nil {
+			fail("sleep_mode", "%v", err)
+		}
+	}
+	if c.HibernateAfter.Duration <= 0 {
+		fail("hibernate_after", "must be positive, got %s", c.HibernateAfter.Duration)
+	}
+
+	// battery_critical_percent has a default, so it only has to be below
+	// battery_low_percent when there is an action to take
+	criticalAction := c.BatteryCriticalAction.Name != "" || len(c.BatteryCriticalAction.Command) > 0
+	if c.BatteryCriticalPercent < 0 || c.BatteryCriticalPercent > 100 {
+		fail("battery_critical_percent", "must be between 0 and 100, got %d", c.BatteryCriticalPercent)
+	} else if criticalAction && c.BatteryCriticalPercent >= c.BatteryLowPercent {
+		fail("battery_critical_percent", "must be less than battery_low_percent (%d), got %d",
+			c.BatteryLowPercent, c.BatteryCriticalPercent)
+	}
+
+	if action := c.BatteryCriticalAction; len(action.Command) > 0 {
+		if _, err := exec.LookPath(action.Command[0]); err != nil {
+			fail("battery_critical_action", "%s not found in PATH", action.Command[0])
+		}
+	} else if action.Name != "" && !slices.Contains(batteryCriticalActions, action.Name) {
+		fail("battery_critical_action", "unknown action %q, must be one of %s or a command",
+			action.Name, strings.Join(batteryCriticalActions, ", "))
+	}
+
+	c.Hooks.validate(fail)
+
+	for _, key := range c.IgnoreInhibitors {
+		if !slices.Contains(timeoutKeys, key) {
+			fail("ignore_inhibitors", "unknown timeout %q, must be one of %s", key, strings.Join(timeoutKeys, ", "))
+		}
+	}
+
+	if !slices.Contains(mediaAudioModes, c.MediaAudioInhibit) {
+		fail("media_audio_inhibit", "unknown mode %q, must be one of %s",
+			c.MediaAudioInhibit, strings.Join(mediaAudioModes, ", "))
+	}
+
+	for name := range c.Profiles {
+		if !slices.Contains(profileNames, name) {
+			failAt("profiles", "profiles."+name, "unknown profile, must be one of %s", strings.Join(profileNames, ", "))
+		}
+	}
+	for _, name := range profileNames {
+		if _, ok := c.Profiles[name]; !ok {
+			continue
+		}
+		c.WithProfile(name).validateValues(func(key, format string, args ...any) {
+			failAt("profiles", "profiles."+name+"."+key, format, args...)
+		})
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validateValues(fail func(key, format string, args ...any)) {
+	if c.BacklightCurveFactor <= 0 {
+		fail("backlight_curve_factor", "must be greater than 0, got %v", c.BacklightCurveFactor)
+	}
+	if c.BacklightDimRatio <= 0 || c.BacklightDimRatio > 1 {
+		fail("backlight_dim_ratio", "must be in (0, 1], got %v", c.BacklightDimRatio)
+	}
+	if c.BacklightSteps < 2 {
+		fail("backlight_steps", "must be at least 2, got %d", c.BacklightSteps)
+	}
+
+	durations := []struct {
+		key   string
+		value Duration
+	}{
+		{"idle_grace_duration", c.IdleGraceDuration},
+		{"lock_init_ignore_input_timeout", c.LockInitIgnoreInputTimeout},
+		{"timeout_active_dim", c.TimeoutActiveDim},
+		{"timeout_active_to_idle", c.TimeoutActiveToIdle},
+		{"timeout_idle_backlight_off", c.TimeoutIdleBacklightOff},
+		{"timeout_idle_to_suspend", c.TimeoutIdleToSuspend},
+	}
+	for _, d := range durations {
+		if d.value.Duration < 0 {
+			fail(d.key, "must not be negative, got %s", d.value.Duration)
+		}
+	}
+
+	if c.TimeoutActiveDim.Duration >= c.TimeoutActiveToIdle.Duration {
+		fail("timeout_active_dim", "must be less than timeout_active_to_idle (%s), got %s",
+			c.TimeoutActiveToIdle.Duration, c.TimeoutActiveDim.Duration)
+	}
+
+	if c.Timeline != nil {
+		c.Timeline.validate(fail)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateBatteryCriticalPercent(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "low below the default critical percent", config: `{"lock_command": ["sleep", "60"], "battery_low_percent": 5}`},
+		{
+			name:    "with a critical action",
+			config:  `{"lock_command": ["sleep", "60"], "battery_low_percent": 5, "battery_critical_action": "hibernate"}`,
+			wantErr: "battery_critical_percent",
+		},
+		{
+			name:   "critical below low",
+			config: `{"lock_command": ["sleep", "60"], "battery_low_percent": 5, "battery_critical_percent": 3, "battery_critical_action": "hibernate"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := decodeConfig("goidle.json", []byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.applyDefaults()
+			err = config.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Validate returned %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate returned %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "valid", config: `{"lock_command": ["sleep", "60"], "backlight_steps": 10}`},
+		{
+			name:    "unknown key",
+			config:  "{\n  \"lock_command\": [\"sleep\", \"60\"],\n  \"timeout_dim\": \"10s\"\n}",
+			wantErr: "goidle.json:3:3: timeout_dim: unknown key",
+		},
+		{
+			name:    "syntax error",
+			config:  "{\n  \"backlight_steps\": 10,\n  \"lock_command\": [\"sleep\" \"60\"]\n}",
+			wantErr: "goidle.json:3:28: invalid character '\"' after array element",
+		},
+		{
+			name:    "type mismatch",
+			config:  "{\n  \"backlight_steps\": \"ten\"\n}",
+			wantErr: "goidle.json:2:3: backlight_steps: cannot use string as int",
+		},
+		{
+			name:    "not an object",
+			config:  `["lock_command"]`,
+			wantErr: "goidle.json:1:1: config must be a JSON object",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeConfig("goidle.json", []byte(tt.config))
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("decodeConfig returned %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("decodeConfig returned %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "valid", config: `{"lock_command": ["sleep", "60"]}`},
+		{
+			name:    "dim ratio above 1",
+			config:  `{"lock_command": ["sleep", "60"], "backlight_dim_ratio": 1.5}`,
+			wantErr: "goidle.json:1:35: backlight_dim_ratio: must be in (0, 1], got 1.5",
+		},
+		{
+			name:    "negative dim ratio",
+			config:  `{"lock_command": ["sleep", "60"], "backlight_dim_ratio": -0.5}`,
+			wantErr: "goidle.json:1:35: backlight_dim_ratio: must be in (0, 1], got -0.5",
+		},
+		{
+			name:    "one backlight step",
+			config:  `{"lock_command": ["sleep", "60"], "backlight_steps": 1}`,
+			wantErr: "goidle.json:1:35: backlight_steps: must be at least 2, got 1",
+		},
+		{
+			name:    "dim after idle",
+			config:  "{\n  \"lock_command\": [\"sleep\", \"60\"],\n  \"timeout_active_dim\": \"5m\",\n  \"timeout_active_to_idle\": \"5m\"\n}",
+			wantErr: "goidle.json:3:3: timeout_active_dim: must be less than timeout_active_to_idle (5m0s), got 5m0s",
+		},
+		{
+			name:    "locker not in PATH",
+			config:  `{"lock_command": ["goidle-test-no-such-locker"]}`,
+			wantErr: "goidle.json:1:2: lock_command: goidle-test-no-such-locker not found in PATH",
+		},
+		{
+			name:    "in a profile",
+			config:  `{"lock_command": ["sleep", "60"], "profiles": {"battery": {"backlight_steps": 1}}}`,
+			wantErr: "goidle.json:1:35: profiles.battery.backlight_steps: must be at least 2, got 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := decodeConfig("goidle.json", []byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.applyDefaults()
+			err = config.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Validate returned %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("Validate returned %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
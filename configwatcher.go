@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ConfigWatcher calls cb whenever the file at configPath is written or
+// replaced. The parent directory is watched rather than the file itself so
+// that editors which save by renaming a temporary file are picked up too.
+func ConfigWatcher(configPath string, cb func()) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		lg.Error("Failed to initialize inotify", "error", err.Error())
+		return
+	}
+	defer unix.Close(fd)
+
+	dir, name := filepath.Split(configPath)
+	if dir == "" {
+		dir = "."
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO); err != nil {
+		lg.Error("Failed to watch config directory", "dir", dir, "error", err.Error())
+		return
+	}
+
+	// editors tend to produce bursts of events for a single save
+	var debounce *time.Timer
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			lg.Error("Failed to read inotify events", "error", err.Error())
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			offset = nameEnd
+
+			eventName := string(buf[nameStart:nameEnd])
+			for len(eventName) > 0 && eventName[len(eventName)-1] == 0 {
+				eventName = eventName[:len(eventName)-1]
+			}
+			if eventName != name {
+				continue
+			}
+
+			lg.Debug("config file changed", "path", configPath)
+			if debounce != nil {
+				debounce.Stop()
+			}
+			debounce = time.AfterFunc(100*time.Millisecond, cb)
+		}
+	}
+}
@@ -20,30 +20,85 @@ type Notification struct {
 	Summary       string
 	Body          string
 	ExpireTimeout int32
+	Urgency       byte
 }
 
-func MusicStop() {
-	var names []string
+const (
+	UrgencyLow      byte = 0
+	UrgencyNormal   byte = 1
+	UrgencyCritical byte = 2
+)
+
+func SendNotification(n Notification) {
 	conn := dbusConnection()
-	obj := conn.Object("org.freedesktop.DBus", "/org/freedesktop/DBus")
-	call := obj.Call("org.freedesktop.DBus.ListNames", 0)
+	if conn == nil {
+		return
+	}
+	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	hints := map[string]dbus.Variant{"urgency": dbus.MakeVariant(n.Urgency)}
+	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
+		"goidle", uint32(0), n.Icon, n.Summary, n.Body, []string{}, hints, n.ExpireTimeout)
 	if call.Err != nil {
-		panic(call.Err)
+		lg.Error("Failed to send notification", "error", call.Err.Error())
+	}
+}
+
+// MusicStop pauses every MPRIS player that is playing and returns the bus
+// names of the players it paused.
+func MusicStop() []string {
+	conn := dbusConnection()
+	if conn == nil {
+		return nil
 	}
-	var players []string
-	call.Store(&names)
+	var names []string
+	obj := conn.Object("org.freedesktop.DBus", "/org/freedesktop/DBus")
+	if err := obj.Call("org.freedesktop.DBus.ListNames", 0).Store(&names); err != nil {
+		lg.Error("Failed to list bus names", "error", err.Error())
+		return nil
+	}
+
+	var paused []string
 	for _, name := range names {
-		if strings.HasPrefix(name, "org.mpris.MediaPlayer2.") {
-			players = append(players, name)
+		if !strings.HasPrefix(name, mprisPrefix) {
+			continue
+		}
+		mediaPlayer := conn.Object(name, mprisPath)
+		status, err := mediaPlayer.GetProperty(mprisPlayerIface + ".PlaybackStatus")
+		if err != nil {
+			lg.Error("Failed to get PlaybackStatus", "player", name, "error", err.Error())
+			continue
+		}
+		if status.Value() != "Playing" {
+			continue
+		}
+		lg.Debug("pausing", "player", name)
+		if call := mediaPlayer.Call(mprisPlayerIface+".Pause", 0); call.Err != nil {
+			lg.Error("Failed to send pause command", "player", name, "error", call.Err.Error())
+			continue
 		}
+		paused = append(paused, name)
 	}
+	return paused
+}
 
-	for _, player := range players {
-		mediaPlayer := conn.Object(player, "/org/mpris/MediaPlayer2")
-		lg.Debug("pausing", "", player)
-		call := mediaPlayer.Call("org.mpris.MediaPlayer2.Player.Pause", 0)
-		if call.Err != nil {
-			lg.Error("Failed to send pause command", "", call.Err)
+// MusicResume resumes the players paused by MusicStop that are allowed by
+// media_resume_players and media_resume_ignore_players.
+func MusicResume(config *Config, players []string) {
+	conn := dbusConnection()
+	if conn == nil {
+		return
+	}
+	for _, name := range players {
+		player := strings.TrimPrefix(name, mprisPrefix)
+		if matchPlayer(config.MediaResumeIgnorePlayers, player) {
+			continue
+		}
+		if len(config.MediaResumePlayers) > 0 && !matchPlayer(config.MediaResumePlayers, player) {
+			continue
+		}
+		lg.Debug("resuming", "player", name)
+		if call := conn.Object(name, mprisPath).Call(mprisPlayerIface+".Play", 0); call.Err != nil {
+			lg.Error("Failed to send play command", "player", name, "error", call.Err.Error())
 		}
 	}
 }
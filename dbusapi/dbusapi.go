@@ -0,0 +1,30 @@
+// Package dbusapi holds the names and types of the io.github.trbjo.GoIdle
+// D-Bus interface, shared by goidle and its clients.
+package dbusapi
+
+const (
+	BusName   = "io.github.trbjo.GoIdle"
+	Interface = "io.github.trbjo.GoIdle"
+	Path      = "/io/github/trbjo/GoIdle"
+)
+
+// InhibitorInfo is an inhibitor as returned by ListInhibitors. Since and
+// Expires are unix timestamps, Expires is 0 when the inhibitor does not expire.
+type InhibitorInfo struct {
+	Cookie  uint32 `json:"cookie"`
+	Kind    string `json:"kind"`
+	Owner   string `json:"owner"`
+	App     string `json:"app"`
+	Reason  string `json:"reason"`
+	Since   int64  `json:"since"`
+	Expires int64  `json:"expires"`
+}
+
+// Names of the errors returned by the methods of Interface.
+const (
+	ErrorNoSuchOutput    = Interface + ".Error.NoSuchOutput"
+	ErrorNoNetwork       = Interface + ".Error.NoNetwork"
+	ErrorInvalidDuration = Interface + ".Error.InvalidDuration"
+	ErrorSuspendFailed   = Interface + ".Error.SuspendFailed"
+	ErrorLockerFailed    = Interface + ".Error.LockerFailed"
+)
@@ -1,56 +1,119 @@
 package main
 
 import (
-	"github.com/godbus/dbus/v5"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+
+	"github.com/trbjo/goidle/dbusapi"
 	"github.com/trbjo/goidle/logger"
 )
 
 const (
-	dbusInterface = "io.github.trbjo.GoIdle"
-	dbusPath	  = "/io/github/trbjo/GoIdle"
+	dbusInterface = dbusapi.Interface
+	dbusPath      = dbusapi.Path
 )
 
 type GoIdleDbus struct {
-	config		   *Config
-	opm			  *OutputPowerManager
-	userRequestsFunc func(UserRequest)
-	lidEventsFunc	func(LidEvent)
-	backlightFunc	func(BackLight)
+	config        *SafeState[*Config]
+	state         *RuntimeState
+	opm           *OutputPowerManager
+	post          func(Event)
+	backlightFunc func(BackLight)
+	reloadFunc    func() error
+	requestFunc   func(UserRequest) error
+	inhibitors    *InhibitorRegistry
+	conn          *dbus.Conn
+	caffeine      *Caffeine
+	props         *Properties
 }
 
-func (o *GoIdleDbus) Suspend() *dbus.Error {
-	go func() { o.userRequestsFunc(Suspend) }()
+type InhibitorInfo = dbusapi.InhibitorInfo
+
+// newError returns a D-Bus error with the message of err.
+func newError(name string, err error) *dbus.Error {
+	return dbus.NewError(name, []interface{}{err.Error()})
+}
+
+// dbusError names err after its cause, unknown causes are reported as
+// org.freedesktop.DBus.Error.Failed.
+func dbusError(err error) *dbus.Error {
+	var arpErr *ArpError
+	switch {
+	case errors.Is(err, ErrNoSuchOutput):
+		return newError(dbusapi.ErrorNoSuchOutput, err)
+	case errors.As(err, &arpErr):
+		return newError(dbusapi.ErrorNoNetwork, err)
+	case errors.Is(err, ErrSuspendFailed):
+		return newError(dbusapi.ErrorSuspendFailed, err)
+	case errors.Is(err, ErrLockerFailed):
+		return newError(dbusapi.ErrorLockerFailed, err)
+	}
+	return dbus.MakeFailedError(err)
+}
+
+// request runs req and returns once it took effect.
+func (o *GoIdleDbus) request(req UserRequest) *dbus.Error {
+	if err := o.requestFunc(req); err != nil {
+		return dbusError(err)
+	}
 	return nil
 }
 
+// Suspend returns after the system resumed.
+func (o *GoIdleDbus) Suspend() *dbus.Error {
+	return o.request(Suspend)
+}
+
+func (o *GoIdleDbus) Hibernate() *dbus.Error {
+	return o.request(Hibernate)
+}
+
+func (o *GoIdleDbus) HybridSleep() *dbus.Error {
+	return o.request(HybridSleep)
+}
+
+// Lock returns once the locker is running.
 func (o *GoIdleDbus) Lock() *dbus.Error {
-	go func() { o.userRequestsFunc(Lock) }()
-	return nil
+	return o.request(Lock)
 }
 
 func (o *GoIdleDbus) LidClose() *dbus.Error {
-	go func() { o.lidEventsFunc(LidClose) }()
+	go func() { o.post(LidClose) }()
+	o.props.Changed(dbusInterface, "LidClosed")
 	return nil
 }
 
 func (o *GoIdleDbus) LidOpen() *dbus.Error {
-	go func() { o.lidEventsFunc(LidOpen) }()
+	go func() { o.post(LidOpen) }()
+	o.props.Changed(dbusInterface, "LidClosed")
 	return nil
 }
 
-func (o *GoIdleDbus) WifiTrust() *dbus.Error {
-	o.config.AddCurrentWifi()
-	o.config.Dump()
-	return nil
+// WifiTrust returns the MAC address of the network trusted.
+func (o *GoIdleDbus) WifiTrust() (string, *dbus.Error) {
+	mac, err := o.state.AddCurrentWifi()
+	if err != nil {
+		return "", dbusError(err)
+	}
+	o.props.Changed(dbusInterface, "TrustedNetwork")
+	return mac, nil
 }
 
-func (o *GoIdleDbus) WifiDistrust() *dbus.Error {
-	o.config.RemoveCurrentWifi()
-	o.config.Dump()
-	return nil
+// WifiDistrust returns the MAC address of the network distrusted.
+func (o *GoIdleDbus) WifiDistrust() (string, *dbus.Error) {
+	mac, err := o.state.RemoveCurrentWifi()
+	if err != nil {
+		return "", dbusError(err)
+	}
+	o.props.Changed(dbusInterface, "TrustedNetwork")
+	return mac, nil
 }
 
 func (o *GoIdleDbus) LogDebug() *dbus.Error {
@@ -71,32 +134,131 @@ func (o *GoIdleDbus) LogInfo() *dbus.Error {
 func (o *GoIdleDbus) IdleGraceDuration(graceDuration string) *dbus.Error {
 	duration, err := time.ParseDuration(graceDuration)
 	if err != nil {
-		return dbus.NewError(err.Error(), []interface{}{})
+		return newError(dbusapi.ErrorInvalidDuration, err)
+	}
+	if duration < 0 {
+		return newError(dbusapi.ErrorInvalidDuration, fmt.Errorf("duration must not be negative, got %s", graceDuration))
 	}
-	lg.Info(graceDuration)
-	o.config.IdleGraceDuration.Duration = duration
-	o.config.Dump()
+	lg.Info("Idle grace duration set", "duration", duration)
+	if err := o.state.SetGraceDuration(duration); err != nil {
+		lg.Error("Failed to save state", "error", err.Error())
+	}
+	o.props.Changed(dbusInterface, "IdleGraceDuration")
 	return nil
 }
 
-func (o *GoIdleDbus) ToggleOutput(output string) *dbus.Error {
-	lg.Info("output toggled")
-	err := o.opm.ToggleOutput(output)
+// ToggleOutput returns the new mode of the output, "on" or "off".
+func (o *GoIdleDbus) ToggleOutput(output string) (string, *dbus.Error) {
+	on, err := o.opm.ToggleOutput(output)
+	if err != nil {
+		lg.Error("Failed to toggle output", "output", output, "error", err.Error())
+		return "", dbusError(err)
+	}
+	lg.Info("output toggled", "output", output, "on", on)
+	if on {
+		return "on", nil
+	}
+	return "off", nil
+}
+
+// ListOutputs returns the names of the connected outputs, sorted.
+func (o *GoIdleDbus) ListOutputs() ([]string, *dbus.Error) {
+	return o.opm.ListOutputNames(), nil
+}
+
+// callerName returns the process name of a D-Bus caller for display, falling
+// back to its bus name.
+func (o *GoIdleDbus) callerName(sender dbus.Sender) string {
+	var pid uint32
+	err := o.conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixProcessID", 0, string(sender)).Store(&pid)
 	if err != nil {
-		lg.Error(err.Error())
+		return string(sender)
 	}
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return string(sender)
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// IdleInhibit blocks idle until the cookie is released or the caller leaves
+// the bus.
+func (o *GoIdleDbus) IdleInhibit(sender dbus.Sender, reason string) (uint32, *dbus.Error) {
+	return o.inhibitors.Add(string(sender), o.callerName(sender), reason, 0), nil
+}
+
+// IdleInhibitFor blocks idle for the given duration. It is not tied to the
+// caller's connection, so it can be used from one-shot tools like dbus-send.
+func (o *GoIdleDbus) IdleInhibitFor(sender dbus.Sender, duration string, reason string) (uint32, *dbus.Error) {
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, newError(dbusapi.ErrorInvalidDuration, err)
+	}
+	if d <= 0 {
+		return 0, newError(dbusapi.ErrorInvalidDuration, fmt.Errorf("duration must be positive, got %s", duration))
+	}
+	return o.inhibitors.Add("", o.callerName(sender), reason, d), nil
+}
+
+func (o *GoIdleDbus) IdleRelease(sender dbus.Sender, cookie uint32) *dbus.Error {
+	inhibitor, ok := o.inhibitors.Get(cookie)
+	if !ok {
+		return dbus.MakeFailedError(fmt.Errorf("no inhibitor with cookie %d", cookie))
+	}
+	if inhibitor.Owner != "" && inhibitor.Owner != string(sender) {
+		return dbus.MakeFailedError(fmt.Errorf("inhibitor %d is owned by %s", cookie, inhibitor.Owner))
+	}
+	o.inhibitors.Remove(cookie)
 	return nil
 }
 
-func (o *GoIdleDbus) IdleInhibit() *dbus.Error {
-	lg.Debug("IdleInhibit")
-	go func() { o.userRequestsFunc(IdleInhibit) }()
+// IdleAllow releases the caller's inhibitors along with every inhibitor not
+// tied to a connection. Inhibitors held by other applications are kept.
+func (o *GoIdleDbus) IdleAllow(sender dbus.Sender) *dbus.Error {
+	lg.Debug("IdleAllow", "sender", sender)
+	o.inhibitors.RemoveOwner(string(sender))
+	o.inhibitors.RemoveOwner("")
 	return nil
 }
 
-func (o *GoIdleDbus) IdleAllow() *dbus.Error {
-	lg.Debug("IdleAllow")
-	go func() { o.userRequestsFunc(IdleAllow) }()
+func (o *GoIdleDbus) ListInhibitors() ([]InhibitorInfo, *dbus.Error) {
+	return inhibitorInfos(o.inhibitors.List()), nil
+}
+
+func inhibitorInfos(list []Inhibitor) []InhibitorInfo {
+	infos := make([]InhibitorInfo, 0, len(list))
+	for _, inhibitor := range list {
+		info := InhibitorInfo{
+			Cookie: inhibitor.Cookie,
+			Kind:   inhibitor.Kind.String(),
+			Owner:  inhibitor.Owner,
+			App:    inhibitor.App,
+			Reason: inhibitor.Reason,
+			Since:  inhibitor.Since.Unix(),
+		}
+		if !inhibitor.Expires.IsZero() {
+			info.Expires = inhibitor.Expires.Unix()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Caffeinate inhibits idle for a duration, extends it when prefixed with +
+// or cancels it when given "cancel". It returns the seconds remaining.
+func (o *GoIdleDbus) Caffeinate(duration string) (uint32, *dbus.Error) {
+	deadline, err := parseCaffeine(duration, o.caffeine.Deadline(), time.Now())
+	if err != nil {
+		return 0, newError(dbusapi.ErrorInvalidDuration, err)
+	}
+	o.caffeine.Set(deadline)
+	return uint32(o.caffeine.Remaining().Seconds()), nil
+}
+
+func (o *GoIdleDbus) Reload() *dbus.Error {
+	if err := o.reloadFunc(); err != nil {
+		return dbus.MakeFailedError(err)
+	}
 	return nil
 }
 
@@ -111,11 +273,17 @@ func (o *GoIdleDbus) LightDecrease() *dbus.Error {
 }
 
 func setupDbus(
-	config *Config,
+	config *SafeState[*Config],
+	state *RuntimeState,
 	opm *OutputPowerManager,
-	lidEventsFunc func(LidEvent),
-	userRequestsFunc func(UserRequest),
+	post func(Event),
 	backlightFunc func(BackLight),
+	reloadFunc func() error,
+	requestFunc func(UserRequest) error,
+	inhibitors *InhibitorRegistry,
+	caffeine *Caffeine,
+	props *Properties,
+	signals *Signals,
 ) {
 	conn, err := dbus.SessionBus()
 	if err != nil {
@@ -123,7 +291,41 @@ func setupDbus(
 		os.Exit(1)
 	}
 
-	reply, err := conn.RequestName(dbusInterface, dbus.NameFlagDoNotQueue)
+	obj := &GoIdleDbus{
+		config:        config,
+		state:         state,
+		opm:           opm,
+		post:          post,
+		backlightFunc: backlightFunc,
+		reloadFunc:    reloadFunc,
+		requestFunc:   requestFunc,
+		inhibitors:    inhibitors,
+		conn:          conn,
+		caffeine:      caffeine,
+		props:         props,
+	}
+	conn.Export(obj, dbus.ObjectPath(dbusPath), dbusInterface)
+
+	if err := props.Export(conn); err != nil {
+		lg.Error("Failed to export properties", "error", err.Error())
+	}
+	signals.Export(conn)
+	node := &introspect.Node{
+		Name: dbusPath,
+		Interfaces: []introspect.Interface{
+			prop.IntrospectData,
+			{
+				Name:       dbusInterface,
+				Methods:    introspect.Methods(obj),
+				Properties: props.Introspect(dbusInterface),
+				Signals:    goidleSignals,
+			},
+		},
+	}
+	conn.Export(introspect.NewIntrospectable(node), dbusPath, "org.freedesktop.DBus.Introspectable")
+
+	// the name is taken last, so clients watching it find everything exported
+	reply, err := conn.RequestName(dbusapi.BusName, dbus.NameFlagDoNotQueue)
 	if err != nil {
 		lg.Error("Failed to request name", "error", err)
 		os.Exit(1)
@@ -133,15 +335,6 @@ func setupDbus(
 		os.Exit(1)
 	}
 
-	obj := &GoIdleDbus{
-		config:		   config,
-		opm:			  opm,
-		userRequestsFunc: userRequestsFunc,
-		lidEventsFunc:	lidEventsFunc,
-		backlightFunc:	backlightFunc,
-	}
-	conn.Export(obj, dbus.ObjectPath(dbusPath), dbusInterface)
-
 	lg.Debug("Listening on D-Bus", "interface", dbusInterface, "path", dbusPath)
 	select {}
 }
@@ -23,18 +23,33 @@ func (t UserRequest) String() string {
 		return "Lock"
 	case Suspend:
 		return "Suspend"
+	case BatteryCritical:
+		return "BatteryCritical"
+	case Hibernate:
+		return "Hibernate"
+	case HybridSleep:
+		return "HybridSleep"
+	case Unlock:
+		return "Unlock"
 	default:
 		t := strconv.Itoa(int(t))
 		return t
 
 	}
 }
+func (t SleepEvent) String() string {
+	switch t {
+	case SleepResumed:
+		return "SleepResumed"
+	default:
+		t := strconv.Itoa(int(t))
+		return t
+	}
+}
 func (t LockStatus) String() string {
 	switch t {
 	case LockExit:
 		return "LockExit"
-	case UnlockFailed:
-		return "UnlockFailed"
 	default:
 		t := strconv.Itoa(int(t))
 		return t
@@ -42,12 +57,12 @@ func (t LockStatus) String() string {
 	}
 }
 
-type IdleEvent int
 type LidEvent int
 type StateValue int
 type LockStatus int
 type UserRequest int
 type BackLight int
+type SleepEvent int
 
 const (
 	Suspend     UserRequest = 1
@@ -55,15 +70,10 @@ const (
 	IdleInhibit UserRequest = 4
 	IdleAllow   UserRequest = 8
 
-	TryUnlock        IdleEvent = 16
-	IdleRequest      IdleEvent = 32
-	TryIdleToSuspend IdleEvent = 64
-
 	LidClose LidEvent = 128
 	LidOpen  LidEvent = 256
 
 	LockExit LockStatus = 512
-	UnlockFailed LockStatus = 1024
 
 	Active StateValue = 2048
 	Idle   StateValue = 4096
@@ -73,4 +83,11 @@ const (
 	Decrease BackLight = 65536
 	Dim      BackLight = 262144
 	Restore  BackLight = 524288
+
+	BatteryCritical UserRequest = 1048576
+	Hibernate       UserRequest = 2097152
+	HybridSleep     UserRequest = 4194304
+	Unlock          UserRequest = 16777216
+
+	SleepResumed SleepEvent = 8388608
 )
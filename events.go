@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/trbjo/goidle/power"
+)
+
+// Event is anything the PolicyEngine reacts to. Event sources post events to
+// an EventQueue, see PolicyEngine for how each one is handled.
+type Event interface {
+	isEvent()
+}
+
+func (StageEvent) isEvent()  {}
+func (UserRequest) isEvent() {}
+func (LockStatus) isEvent()  {}
+func (LidEvent) isEvent()    {}
+func (SleepEvent) isEvent()  {}
+
+// PowerEvent is sent when the power supply status changes.
+type PowerEvent struct {
+	Status power.Status
+}
+
+// NetworkEvent reports whether the machine is connected to a trusted network,
+// as checked when unlocking after the grace period.
+type NetworkEvent struct {
+	Trusted bool
+}
+
+// OutputEvent is sent when an output is plugged in or removed.
+type OutputEvent struct {
+	Name  string
+	Added bool
+}
+
+// ReloadEvent reloads the config. Result, if set, receives the outcome.
+type ReloadEvent struct {
+	Result chan<- error
+}
+
+// Request is a UserRequest whose outcome is awaited. Result receives nil once
+// the request took effect, e.g. the locker runs or the system slept.
+type Request struct {
+	UserRequest
+	Result chan<- error
+}
+
+type ShutdownEvent struct{}
+
+func (PowerEvent) isEvent()    {}
+func (NetworkEvent) isEvent()  {}
+func (OutputEvent) isEvent()   {}
+func (ReloadEvent) isEvent()   {}
+func (Request) isEvent()       {}
+func (ShutdownEvent) isEvent() {}
+
+// EventQueue is the single stream of events consumed by the PolicyEngine.
+type EventQueue chan Event
+
+func NewEventQueue() EventQueue {
+	return make(EventQueue, 64)
+}
+
+// Post queues an event, waiting while the queue is full.
+func (q EventQueue) Post(ev Event) {
+	q <- ev
+}
+
+// TryPost queues an event unless the queue is full. It is used by callers
+// that must not block, e.g. while holding a lock the engine may need.
+func (q EventQueue) TryPost(ev Event) {
+	select {
+	case q <- ev:
+	default:
+		lg.Warn("Event queue full, dropping event", "event", fmt.Sprintf("%T", ev))
+	}
+}
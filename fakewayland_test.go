@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	outputPowerOff uint32 = 0
+	outputPowerOn  uint32 = 1
+)
+
+// fakeCompositor is an in-process Wayland server for tests. It advertises
+// wl_seat, wl_output, ext_idle_notifier_v1 and zwlr_output_power_manager_v1
+// on a socket that WAYLAND_DISPLAY points to, and implements just enough of
+// them for IdleManager and OutputPowerManager.
+type fakeCompositor struct {
+	t        *testing.T
+	listener *net.UnixListener
+
+	mu       sync.Mutex
+	globals  []*fakeGlobal
+	nextName uint32
+	clients  map[*fakeClient]struct{}
+	// modes holds the power mode of every output by name
+	modes map[string]uint32
+}
+
+type fakeGlobal struct {
+	name    uint32
+	iface   string
+	version uint32
+	// label is the name of a seat or an output
+	label   string
+	removed bool
+}
+
+type fakeClient struct {
+	srv     *fakeCompositor
+	conn    *net.UnixConn
+	objects map[uint32]*fakeObject
+}
+
+type fakeObject struct {
+	id      uint32
+	iface   string
+	version uint32
+	global  *fakeGlobal
+
+	// notifications
+	timeout   uint32
+	seat      *fakeGlobal
+	inputOnly bool
+
+	// output power objects
+	output *fakeGlobal
+}
+
+// fakeNotification is an idle notification registered by a client.
+type fakeNotification struct {
+	client    *fakeClient
+	id        uint32
+	Timeout   time.Duration
+	Seat      string
+	InputOnly bool
+}
+
+// newFakeCompositor starts a compositor advertising ext_idle_notifier_v1 at
+// idleVersion, or not at all when it is 0.
+func newFakeCompositor(t *testing.T, idleVersion uint32) *fakeCompositor {
+	dir, err := os.MkdirTemp("", "goidle-wl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "wayland-test"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	t.Setenv("WAYLAND_DISPLAY", "wayland-test")
+
+	srv := &fakeCompositor{
+		t:        t,
+		listener: listener,
+		clients:  make(map[*fakeClient]struct{}),
+		modes:    make(map[string]uint32),
+	}
+	if idleVersion > 0 {
+		srv.addGlobal("ext_idle_notifier_v1", idleVersion, "")
+	}
+	srv.addGlobal("zwlr_output_power_manager_v1", 1, "")
+	t.Cleanup(func() {
+		listener.Close()
+		srv.DropClients()
+		os.RemoveAll(dir)
+	})
+	go srv.accept()
+	return srv
+}
+
+func (srv *fakeCompositor) accept() {
+	for {
+		conn, err := srv.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		c := &fakeClient{srv: srv, conn: conn, objects: make(map[uint32]*fakeObject)}
+		c.objects[1] = &fakeObject{id: 1, iface: "wl_display"}
+		srv.mu.Lock()
+		srv.clients[c] = struct{}{}
+		srv.mu.Unlock()
+		go c.serve()
+	}
+}
+
+func (srv *fakeCompositor) addGlobal(iface string, version uint32, label string) *fakeGlobal {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.nextName++
+	g := &fakeGlobal{name: srv.nextName, iface: iface, version: version, label: label}
+	srv.globals = append(srv.globals, g)
+	for c := range srv.clients {
+		for _, obj := range c.objects {
+			if obj.iface == "wl_registry" {
+				c.send(obj.id, 0, g.name, g.iface, g.version)
+			}
+		}
+	}
+	return g
+}
+
+func (srv *fakeCompositor) AddSeat(name string) {
+	srv.addGlobal("wl_seat", 7, name)
+}
+
+func (srv *fakeCompositor) AddOutput(name string) {
+	srv.mu.Lock()
+	srv.modes[name] = outputPowerOn
+	srv.mu.Unlock()
+	srv.addGlobal("wl_output", 4, name)
+}
+
+// RemoveOutput unplugs an output. Like wlroots, the output power objects of
+// the output fail.
+func (srv *fakeCompositor) RemoveOutput(name string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, g := range srv.globals {
+		if g.iface != "wl_output" || g.label != name || g.removed {
+			continue
+		}
+		g.removed = true
+		delete(srv.modes, name)
+		for c := range srv.clients {
+			for _, obj := range c.objects {
+				switch {
+				case obj.iface == "wl_registry":
+					c.send(obj.id, 1, g.name)
+				case obj.iface == "zwlr_output_power_v1" && obj.output == g:
+					c.send(obj.id, 1)
+				}
+			}
+		}
+	}
+}
+
+// Failed sends zwlr_output_power_v1.failed to the output power objects of an
+// output, as wlroots does when the output can no longer be managed. The
+// objects are inert afterwards.
+func (srv *fakeCompositor) Failed(name string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.clients {
+		for _, obj := range c.objects {
+			if obj.iface == "zwlr_output_power_v1" && obj.output != nil && obj.output.label == name {
+				c.send(obj.id, 1)
+				obj.output = nil
+			}
+		}
+	}
+}
+
+// DropClients closes the connection of every client, as a crashing or
+// restarting compositor would.
+func (srv *fakeCompositor) DropClients() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.clients {
+		c.conn.Close()
+		delete(srv.clients, c)
+	}
+}
+
+func (srv *fakeCompositor) NumClients() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.clients)
+}
+
+// Mode returns the power mode of an output.
+func (srv *fakeCompositor) Mode(output string) (uint32, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	mode, ok := srv.modes[output]
+	return mode, ok
+}
+
+// Notifications lists the idle notifications of all clients.
+func (srv *fakeCompositor) Notifications() []fakeNotification {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var notifications []fakeNotification
+	for c := range srv.clients {
+		for _, obj := range c.objects {
+			if obj.iface != "ext_idle_notification_v1" {
+				continue
+			}
+			n := fakeNotification{
+				client:    c,
+				id:        obj.id,
+				Timeout:   time.Duration(obj.timeout) * time.Millisecond,
+				InputOnly: obj.inputOnly,
+			}
+			if obj.seat != nil {
+				n.Seat = obj.seat.label
+			}
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications
+}
+
+// Idled and Resumed send the events of an idle notification.
+func (srv *fakeCompositor) Idled(n fakeNotification) {
+	srv.sendTo(n.client, n.id, 0)
+}
+
+func (srv *fakeCompositor) Resumed(n fakeNotification) {
+	srv.sendTo(n.client, n.id, 1)
+}
+
+func (srv *fakeCompositor) sendTo(c *fakeClient, id uint32, opcode uint16) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := c.objects[id]; ok {
+		c.send(id, opcode)
+	}
+}
+
+// waitFor polls cond until it holds.
+func (srv *fakeCompositor) waitFor(what string, cond func() bool) {
+	srv.t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			srv.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (c *fakeClient) serve() {
+	defer func() {
+		c.srv.mu.Lock()
+		delete(c.srv.clients, c)
+		c.srv.mu.Unlock()
+		c.conn.Close()
+	}()
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			return
+		}
+		id := binary.LittleEndian.Uint32(header)
+		sizeOpcode := binary.LittleEndian.Uint32(header[4:])
+		body := make([]byte, int(sizeOpcode>>16)-8)
+		if _, err := io.ReadFull(c.conn, body); err != nil {
+			return
+		}
+		c.srv.mu.Lock()
+		c.handle(id, uint16(sizeOpcode), &fakeArgs{data: body})
+		c.srv.mu.Unlock()
+	}
+}
+
+// handle processes a request with srv.mu held.
+func (c *fakeClient) handle(id uint32, opcode uint16, args *fakeArgs) {
+	obj, ok := c.objects[id]
+	if !ok {
+		return
+	}
+	switch obj.iface {
+	case "wl_display":
+		switch opcode {
+		case 0: // sync
+			callback := args.uint()
+			c.send(callback, 0, uint32(0))
+			c.send(1, 1, callback)
+		case 1: // get_registry
+			registry := args.uint()
+			c.objects[registry] = &fakeObject{id: registry, iface: "wl_registry"}
+			for _, g := range c.srv.globals {
+				if !g.removed {
+					c.send(registry, 0, g.name, g.iface, g.version)
+				}
+			}
+		}
+	case "wl_registry":
+		name, iface, version, newID := args.uint(), args.string(), args.uint(), args.uint()
+		var global *fakeGlobal
+		for _, g := range c.srv.globals {
+			if g.name == name {
+				global = g
+			}
+		}
+		if global == nil {
+			return
+		}
+		c.objects[newID] = &fakeObject{id: newID, iface: iface, version: version, global: global}
+		switch iface {
+		case "wl_seat":
+			c.send(newID, 0, uint32(1)) // capabilities: pointer
+			if version >= 2 {
+				c.send(newID, 1, global.label)
+			}
+		case "wl_output":
+			if version >= 4 {
+				c.send(newID, 4, global.label)
+			}
+			if version >= 2 {
+				c.send(newID, 2)
+			}
+		}
+	case "ext_idle_notifier_v1":
+		switch opcode {
+		case 0:
+			delete(c.objects, id)
+		case 1, 2: // get_idle_notification, get_input_idle_notification
+			newID, timeout, seat := args.uint(), args.uint(), args.uint()
+			notification := &fakeObject{id: newID, iface: "ext_idle_notification_v1", timeout: timeout, inputOnly: opcode == 2}
+			if seatObj, ok := c.objects[seat]; ok {
+				notification.seat = seatObj.global
+			}
+			c.objects[newID] = notification
+		}
+	case "zwlr_output_power_manager_v1":
+		switch opcode {
+		case 0: // get_output_power
+			newID, output := args.uint(), args.uint()
+			power := &fakeObject{id: newID, iface: "zwlr_output_power_v1"}
+			c.objects[newID] = power
+			outputObj, ok := c.objects[output]
+			if !ok || outputObj.global.removed {
+				c.send(newID, 1)
+				return
+			}
+			power.output = outputObj.global
+			c.send(newID, 0, c.srv.modes[power.output.label])
+		case 1:
+			delete(c.objects, id)
+		}
+	case "zwlr_output_power_v1":
+		switch opcode {
+		case 0: // set_mode
+			mode := args.uint()
+			if obj.output == nil || obj.output.removed {
+				return
+			}
+			c.srv.modes[obj.output.label] = mode
+			for other := range c.srv.clients {
+				for _, o := range other.objects {
+					if o.iface == "zwlr_output_power_v1" && o.output == obj.output {
+						other.send(o.id, 0, mode)
+					}
+				}
+			}
+		case 1:
+			delete(c.objects, id)
+		}
+	default:
+		// destroy requests are opcode 0 for notifications, wl_output.release
+		// and wl_seat.release are ignored
+		if obj.iface == "ext_idle_notification_v1" && opcode == 0 {
+			delete(c.objects, id)
+		}
+	}
+}
+
+// send writes an event, the arguments are uint32 or string.
+func (c *fakeClient) send(id uint32, opcode uint16, args ...any) {
+	msg := make([]byte, 8)
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case uint32:
+			msg = binary.LittleEndian.AppendUint32(msg, arg)
+		case string:
+			padded := (len(arg) + 1 + 3) &^ 3
+			msg = binary.LittleEndian.AppendUint32(msg, uint32(len(arg)+1))
+			msg = append(msg, arg...)
+			msg = append(msg, make([]byte, padded-len(arg))...)
+		}
+	}
+	binary.LittleEndian.PutUint32(msg, id)
+	binary.LittleEndian.PutUint32(msg[4:], uint32(len(msg))<<16|uint32(opcode))
+	c.conn.Write(msg)
+}
+
+type fakeArgs struct {
+	data []byte
+}
+
+func (a *fakeArgs) uint() uint32 {
+	v := binary.LittleEndian.Uint32(a.data)
+	a.data = a.data[4:]
+	return v
+}
+
+func (a *fakeArgs) string() string {
+	length := int(a.uint())
+	padded := (length + 3) &^ 3
+	s, _, _ := strings.Cut(string(a.data[:length]), "\x00")
+	a.data = a.data[padded:]
+	return s
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = 10 * time.Second
+
+// Hook is a command run on a transition. It is written either as a command
+// array or as an object with a command and a timeout.
+type Hook struct {
+	Command []string `json:"command"`
+	Timeout Duration `json:"timeout"`
+}
+
+func (h *Hook) UnmarshalJSON(b []byte) error {
+	var command []string
+	if err := json.Unmarshal(b, &command); err == nil {
+		h.Command = command
+	} else {
+		type hook Hook
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode((*hook)(h)); err != nil {
+			return fmt.Errorf("hook must be a command array or an object with command and timeout: %w", err)
+		}
+	}
+	if len(h.Command) == 0 {
+		return fmt.Errorf("hook command must not be empty")
+	}
+	return nil
+}
+
+type Hooks struct {
+	OnDim        *Hook `json:"on_dim"`
+	OnUndim      *Hook `json:"on_undim"`
+	OnLock       *Hook `json:"on_lock"`
+	OnUnlock     *Hook `json:"on_unlock"`
+	OnOutputsOff *Hook `json:"on_outputs_off"`
+	OnOutputsOn  *Hook `json:"on_outputs_on"`
+	BeforeSleep  *Hook `json:"before_sleep"`
+	AfterResume  *Hook `json:"after_resume"`
+	OnLidClose   *Hook `json:"on_lid_close"`
+	OnLidOpen    *Hook `json:"on_lid_open"`
+}
+
+// byName maps the config keys to the hooks, for validation and logging.
+func (h Hooks) byName() map[string]*Hook {
+	return map[string]*Hook{
+		"on_dim":         h.OnDim,
+		"on_undim":       h.OnUndim,
+		"on_lock":        h.OnLock,
+		"on_unlock":      h.OnUnlock,
+		"on_outputs_off": h.OnOutputsOff,
+		"on_outputs_on":  h.OnOutputsOn,
+		"before_sleep":   h.BeforeSleep,
+		"after_resume":   h.AfterResume,
+		"on_lid_close":   h.OnLidClose,
+		"on_lid_open":    h.OnLidOpen,
+	}
+}
+
+func (h Hooks) validate(fail func(key, format string, args ...any)) {
+	for name, hook := range h.byName() {
+		if hook == nil {
+			continue
+		}
+		if _, err := exec.LookPath(hook.Command[0]); err != nil {
+			fail("hooks."+name, "%s not found in PATH", hook.Command[0])
+		}
+		if hook.Timeout.Duration < 0 {
+			fail("hooks."+name+".timeout", "must not be negative, got %s", hook.Timeout.Duration)
+		}
+	}
+}
+
+// HookRunner runs the configured hooks with the GOIDLE_* environment.
+type HookRunner struct {
+	config  *SafeState[*Config]
+	state   func() StateValue
+	outputs func() []string
+}
+
+func NewHookRunner(config *SafeState[*Config], state func() StateValue, outputs func() []string) *HookRunner {
+	return &HookRunner{config: config, state: state, outputs: outputs}
+}
+
+// Run runs the named hook in the background.
+func (r *HookRunner) Run(name, reason string) {
+	if hook := r.config.Get().Hooks.byName()[name]; hook != nil {
+		go r.run(hook, name, reason)
+	}
+}
+
+// RunSync runs the named hook and waits for it to exit or time out.
+func (r *HookRunner) RunSync(name, reason string) {
+	if hook := r.config.Get().Hooks.byName()[name]; hook != nil {
+		r.run(hook, name, reason)
+	}
+}
+
+func (r *HookRunner) run(hook *Hook, name, reason string) {
+	timeout := hook.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GOIDLE_HOOK="+name,
+		"GOIDLE_STATE="+stateName(r.state()),
+		"GOIDLE_REASON="+reason,
+		"GOIDLE_OUTPUTS="+strings.Join(r.outputs(), ","),
+	)
+	// don't wait for children that keep the output open
+	cmd.WaitDelay = time.Second
+
+	output, writer := io.Pipe()
+	defer writer.Close()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	go logHookOutput(name, output)
+
+	lg.Debug("running hook", "hook", name, "reason", reason)
+	err := cmd.Run()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		lg.Warn("Hook timed out", "hook", name, "timeout", timeout)
+	case err != nil:
+		lg.Error("Hook failed", "hook", name, "error", err.Error())
+	}
+}
+
+// stateName is the name of a state as passed to hooks and reported by the
+// State property.
+func stateName(state StateValue) string {
+	switch state {
+	case Active:
+		return "active"
+	case Idle:
+		return "idle"
+	default:
+		return "none"
+	}
+}
+
+func logHookOutput(name string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lg.Info(scanner.Text(), "hook", name)
+	}
+}
@@ -18,6 +18,8 @@ type IdleManager struct {
 	display       *client.Display
 	registry      *client.Registry
 	idleManager   *ext_idle_notify.IdleNotifier
+	version       uint32
+	warnedVersion bool
 	defaultSeat   *client.Seat
 	notifications map[*ext_idle_notify.IdleNotification]struct{}
 	mu            sync.Mutex
@@ -61,7 +63,7 @@ func (im *IdleManager) initialize(seatName string) error {
 		case "wl_seat":
 			seat := client.NewSeat(im.display.Context())
 			if err := im.registry.Bind(e.Name, e.Interface, e.Version, seat); err != nil {
-				lg.Error("Failed to bind seat", err)
+				lg.Error("Failed to bind seat", "error", err.Error())
 				return
 			}
 
@@ -97,10 +99,12 @@ func (im *IdleManager) initialize(seatName string) error {
 		return fmt.Errorf("no valid seat found")
 	}
 
+	im.version = min(idleManagerVersion, 2)
 	im.idleManager = ext_idle_notify.NewIdleNotifier(im.display.Context())
-	if err := im.registry.Bind(idleManagerName, "ext_idle_notifier_v1", idleManagerVersion, im.idleManager); err != nil {
+	if err := im.registry.Bind(idleManagerName, "ext_idle_notifier_v1", im.version, im.idleManager); err != nil {
 		return fmt.Errorf("failed to bind idle manager: %w", err)
 	}
+	lg.Debug("Bound ext_idle_notifier_v1", "version", im.version)
 
 	return nil
 }
@@ -128,12 +132,48 @@ func (im *IdleManager) displayRoundTrip() {
 	}
 }
 
-func (im *IdleManager) RegisterIdleTimeout(timeout time.Duration, onIdle func(), onResume func()) *ext_idle_notify.IdleNotification {
+// getInputIdleNotification sends get_input_idle_notification, added in
+// version 2 of ext_idle_notifier_v1. Unlike get_idle_notification the
+// compositor ignores idle inhibitors for these notifications.
+func (im *IdleManager) getInputIdleNotification(timeout uint32, seat *client.Seat) (*ext_idle_notify.IdleNotification, error) {
+	i := im.idleManager
+	id := ext_idle_notify.NewIdleNotification(i.Context())
+	const opcode = 2
+	const _reqBufLen = 8 + 4 + 4 + 4
+	var _reqBuf [_reqBufLen]byte
+	l := 0
+	client.PutUint32(_reqBuf[l:4], i.ID())
+	l += 4
+	client.PutUint32(_reqBuf[l:l+4], uint32(_reqBufLen<<16|opcode&0x0000ffff))
+	l += 4
+	client.PutUint32(_reqBuf[l:l+4], id.ID())
+	l += 4
+	client.PutUint32(_reqBuf[l:l+4], uint32(timeout))
+	l += 4
+	client.PutUint32(_reqBuf[l:l+4], seat.ID())
+	l += 4
+	err := i.Context().WriteMsg(_reqBuf[:], nil)
+	return id, err
+}
+
+// RegisterIdleTimeout creates an idle notification. With ignoreInhibitors
+// it fires on input idleness alone, if the compositor supports it.
+func (im *IdleManager) RegisterIdleTimeout(timeout time.Duration, ignoreInhibitors bool, onIdle func(), onResume func()) IdleTimeout {
 	im.mu.Lock()
 	defer im.mu.Unlock()
 
 	timeoutMs := uint32(timeout / time.Millisecond)
-	idleNotification, err := im.idleManager.GetIdleNotification(timeoutMs, im.defaultSeat)
+	var idleNotification *ext_idle_notify.IdleNotification
+	var err error
+	if ignoreInhibitors && im.version >= 2 {
+		idleNotification, err = im.getInputIdleNotification(timeoutMs, im.defaultSeat)
+	} else {
+		if ignoreInhibitors && !im.warnedVersion {
+			im.warnedVersion = true
+			lg.Warn("Compositor does not support ext_idle_notifier_v1 version 2, ignore_inhibitors has no effect")
+		}
+		idleNotification, err = im.idleManager.GetIdleNotification(timeoutMs, im.defaultSeat)
+	}
 	if err != nil {
 		lg.Error("Failed to register idle timeout", "error", err.Error())
 		return nil
@@ -151,11 +191,12 @@ func (im *IdleManager) RegisterIdleTimeout(timeout time.Duration, onIdle func(),
 	return idleNotification
 }
 
-func (im *IdleManager) UnregisterIdleTimeout(notification *ext_idle_notify.IdleNotification) {
+func (im *IdleManager) UnregisterIdleTimeout(timeout IdleTimeout) {
 	im.mu.Lock()
 	defer im.mu.Unlock()
 
-	if _, exists := im.notifications[notification]; !exists {
+	notification, ok := timeout.(*ext_idle_notify.IdleNotification)
+	if _, exists := im.notifications[notification]; !ok || !exists {
 		lg.Warn("No notification found")
 		return
 	}
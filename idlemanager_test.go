@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleManagerSeat(t *testing.T) {
+	tests := []struct {
+		name     string
+		idleSeat string
+		want     string
+	}{
+		{name: "configured seat", idleSeat: "seat1", want: "seat1"},
+		{name: "first seat by default", idleSeat: "", want: "seat0"},
+		{name: "unknown seat falls back to the first", idleSeat: "seat9", want: "seat0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeCompositor(t, 2)
+			srv.AddSeat("seat0")
+			srv.AddSeat("seat1")
+
+			im, err := NewIdleManager(tt.idleSeat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer im.Close()
+
+			im.RegisterIdleTimeout(time.Minute, false, func() {}, func() {})
+			srv.waitFor("idle notification", func() bool { return len(srv.Notifications()) == 1 })
+			if got := srv.Notifications()[0].Seat; got != tt.want {
+				t.Errorf("notification on %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdleManagerMissingNotifier(t *testing.T) {
+	srv := newFakeCompositor(t, 0)
+	srv.AddSeat("seat0")
+	if _, err := NewIdleManager(""); err == nil {
+		t.Fatal("NewIdleManager succeeded without ext_idle_notifier_v1")
+	}
+}
+
+func TestIdleManagerNotifications(t *testing.T) {
+	tests := []struct {
+		name             string
+		version          uint32
+		ignoreInhibitors bool
+		wantInputOnly    bool
+	}{
+		{name: "idle notification", version: 2},
+		{name: "input idle notification", version: 2, ignoreInhibitors: true, wantInputOnly: true},
+		{name: "input idle notification unsupported", version: 1, ignoreInhibitors: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeCompositor(t, tt.version)
+			srv.AddSeat("seat0")
+
+			im, err := NewIdleManager("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer im.Close()
+
+			// the wayland context is not safe for concurrent use, so register
+			// before dispatching like main does
+			events := make(chan string, 2)
+			im.RegisterIdleTimeout(90*time.Second, tt.ignoreInhibitors,
+				func() { events <- "idled" },
+				func() { events <- "resumed" },
+			)
+			srv.waitFor("idle notification", func() bool { return len(srv.Notifications()) == 1 })
+			n := srv.Notifications()[0]
+			if n.Timeout != 90*time.Second {
+				t.Errorf("timeout = %s, want 90s", n.Timeout)
+			}
+			if n.InputOnly != tt.wantInputOnly {
+				t.Errorf("input only = %v, want %v", n.InputOnly, tt.wantInputOnly)
+			}
+
+			go im.Run()
+
+			for _, want := range []string{"idled", "resumed"} {
+				if want == "idled" {
+					srv.Idled(n)
+				} else {
+					srv.Resumed(n)
+				}
+				select {
+				case got := <-events:
+					if got != want {
+						t.Fatalf("got %s, want %s", got, want)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("no %s event", want)
+				}
+			}
+		})
+	}
+}
+
+func TestIdleManagerUnregister(t *testing.T) {
+	srv := newFakeCompositor(t, 2)
+	srv.AddSeat("seat0")
+
+	im, err := NewIdleManager("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+
+	first := im.RegisterIdleTimeout(time.Minute, false, func() {}, func() {})
+	im.RegisterIdleTimeout(2*time.Minute, false, func() {}, func() {})
+	srv.waitFor("idle notifications", func() bool { return len(srv.Notifications()) == 2 })
+
+	im.UnregisterIdleTimeout(first)
+	srv.waitFor("notification to be destroyed", func() bool { return len(srv.Notifications()) == 1 })
+	if got := srv.Notifications()[0].Timeout; got != 2*time.Minute {
+		t.Errorf("remaining notification has timeout %s, want 2m", got)
+	}
+	// unknown timeouts are ignored
+	im.UnregisterIdleTimeout(first)
+	im.UnregisterIdleTimeout(nil)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+type InhibitKind int
+
+const (
+	// InhibitIdle keeps the screen from dimming, turning off and locking.
+	InhibitIdle InhibitKind = iota
+	// InhibitLock only keeps the screen from locking.
+	InhibitLock
+)
+
+func (k InhibitKind) String() string {
+	if k == InhibitLock {
+		return "lock"
+	}
+	return "idle"
+}
+
+type Inhibitor struct {
+	Cookie uint32
+	Kind   InhibitKind
+	// Owner is the unique bus name of the caller. Inhibitors without an owner
+	// are not released when a client disconnects.
+	Owner  string
+	App    string
+	Reason string
+	Since  time.Time
+	// Expires is zero for inhibitors that last until they are released.
+	Expires time.Time
+
+	timer *time.Timer
+}
+
+// InhibitorRegistry keeps track of everything currently blocking idle. It
+// calls onChange whenever idle or the lock goes from allowed to inhibited or
+// back.
+type InhibitorRegistry struct {
+	mu         sync.Mutex
+	nextCookie uint32
+	inhibitors map[uint32]*Inhibitor
+	onChange   func(inhibited bool)
+	onUpdate   func()
+}
+
+func NewInhibitorRegistry(onChange func(inhibited bool)) *InhibitorRegistry {
+	return &InhibitorRegistry{
+		inhibitors: make(map[uint32]*Inhibitor),
+		onChange:   onChange,
+	}
+}
+
+// inhibited reports whether idle and the lock are inhibited. It must be
+// called with the lock held.
+func (r *InhibitorRegistry) inhibited() (idle bool, lock bool) {
+	for _, inhibitor := range r.inhibitors {
+		if inhibitor.Kind == InhibitIdle {
+			return true, true
+		}
+		lock = true
+	}
+	return false, lock
+}
+
+// update runs fn under the lock and calls onChange if it changed whether idle
+// or the lock is inhibited.
+func (r *InhibitorRegistry) update(fn func()) {
+	r.mu.Lock()
+	idleBefore, lockBefore := r.inhibited()
+	fn()
+	idleAfter, lockAfter := r.inhibited()
+	r.mu.Unlock()
+
+	if idleBefore != idleAfter || lockBefore != lockAfter {
+		lg.Debug("idle inhibition changed", "idle", idleAfter, "lock", lockAfter)
+		r.onChange(idleAfter)
+	}
+	if r.onUpdate != nil {
+		r.onUpdate()
+	}
+}
+
+// OnUpdate sets a function called after any inhibitor was added or removed.
+// It must be set before the first inhibitor is added.
+func (r *InhibitorRegistry) OnUpdate(fn func()) {
+	r.onUpdate = fn
+}
+
+// Add registers an inhibitor and returns its cookie. If timeout is positive
+// the inhibitor is released by itself once it has passed.
+func (r *InhibitorRegistry) Add(owner, app, reason string, timeout time.Duration) uint32 {
+	return r.add(InhibitIdle, owner, app, reason, timeout)
+}
+
+// AddLock registers an inhibitor that keeps the screen from locking but lets
+// it dim and turn off.
+func (r *InhibitorRegistry) AddLock(owner, app, reason string) uint32 {
+	return r.add(InhibitLock, owner, app, reason, 0)
+}
+
+func (r *InhibitorRegistry) add(kind InhibitKind, owner, app, reason string, timeout time.Duration) uint32 {
+	var cookie uint32
+	r.update(func() {
+		r.nextCookie++
+		cookie = r.nextCookie
+		now := time.Now()
+		inhibitor := &Inhibitor{
+			Cookie: cookie,
+			Kind:   kind,
+			Owner:  owner,
+			App:    app,
+			Reason: reason,
+			Since:  now,
+		}
+		if timeout > 0 {
+			inhibitor.Expires = now.Add(timeout)
+			inhibitor.timer = time.AfterFunc(timeout, func() {
+				if r.Remove(cookie) {
+					lg.Info("Idle inhibitor expired", "cookie", cookie, "app", app)
+				}
+			})
+		}
+		r.inhibitors[cookie] = inhibitor
+	})
+	lg.Info("Idle inhibited", "cookie", cookie, "kind", kind.String(), "app", app, "reason", reason, "timeout", timeout)
+	return cookie
+}
+
+// remove deletes an inhibitor and stops its expiry timer. It must be called
+// with the lock held.
+func (r *InhibitorRegistry) remove(cookie uint32) {
+	if inhibitor, ok := r.inhibitors[cookie]; ok {
+		if inhibitor.timer != nil {
+			inhibitor.timer.Stop()
+		}
+		delete(r.inhibitors, cookie)
+	}
+}
+
+// Remove releases the inhibitor with the given cookie and reports whether it
+// existed.
+func (r *InhibitorRegistry) Remove(cookie uint32) bool {
+	found := false
+	r.update(func() {
+		if _, found = r.inhibitors[cookie]; found {
+			r.remove(cookie)
+		}
+	})
+	if found {
+		lg.Info("Idle inhibitor released", "cookie", cookie)
+	}
+	return found
+}
+
+// RemoveOwner releases every inhibitor held by the bus name owner and returns
+// how many there were.
+func (r *InhibitorRegistry) RemoveOwner(owner string) int {
+	removed := 0
+	r.update(func() {
+		for cookie, inhibitor := range r.inhibitors {
+			if inhibitor.Owner == owner {
+				lg.Info("Idle inhibitor released", "cookie", cookie, "app", inhibitor.App, "owner", owner)
+				r.remove(cookie)
+				removed++
+			}
+		}
+	})
+	return removed
+}
+
+func (r *InhibitorRegistry) Get(cookie uint32) (Inhibitor, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	inhibitor, ok := r.inhibitors[cookie]
+	if !ok {
+		return Inhibitor{}, false
+	}
+	return *inhibitor, true
+}
+
+// Inhibited reports whether anything keeps the screen from dimming, turning
+// off and locking.
+func (r *InhibitorRegistry) Inhibited() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idle, _ := r.inhibited()
+	return idle
+}
+
+// LockInhibited reports whether anything keeps the screen from locking.
+func (r *InhibitorRegistry) LockInhibited() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, lock := r.inhibited()
+	return lock
+}
+
+// List returns the current inhibitors, oldest first.
+func (r *InhibitorRegistry) List() []Inhibitor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]Inhibitor, 0, len(r.inhibitors))
+	for _, inhibitor := range r.inhibitors {
+		list = append(list, *inhibitor)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Cookie < list[j].Cookie })
+	return list
+}
+
+// WatchOwners releases the inhibitors of clients that disconnect from the bus
+// without releasing them, e.g. because they crashed.
+func (r *InhibitorRegistry) WatchOwners(conn *dbus.Conn) {
+	err := conn.AddMatchSignal(
+		dbus.WithMatchSender("org.freedesktop.DBus"),
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+	)
+	if err != nil {
+		lg.Error("Failed to add match for NameOwnerChanged", "error", err.Error())
+		return
+	}
+
+	signalChan := make(chan *dbus.Signal, 16)
+	conn.Signal(signalChan)
+
+	go func() {
+		for signal := range signalChan {
+			if signal.Name != "org.freedesktop.DBus.NameOwnerChanged" || len(signal.Body) != 3 {
+				continue
+			}
+			name, _ := signal.Body[0].(string)
+			newOwner, _ := signal.Body[2].(string)
+			if name != "" && newOwner == "" {
+				r.RemoveOwner(name)
+			}
+		}
+	}()
+}
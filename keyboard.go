@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const ledsPath = "/sys/class/leds"
+
+// KeyboardBacklight turns keyboard backlights off and restores their previous
+// brightness. Keyboard backlights are the LED devices named *::kbd_backlight.
+type KeyboardBacklight struct {
+	saved map[string]int
+}
+
+func NewKeyboardBacklight() *KeyboardBacklight {
+	return &KeyboardBacklight{saved: make(map[string]int)}
+}
+
+func (k *KeyboardBacklight) Off() {
+	devices, err := filepath.Glob(filepath.Join(ledsPath, "*kbd_backlight*"))
+	if err != nil || len(devices) == 0 {
+		lg.Debug("no keyboard backlight found")
+		return
+	}
+	for _, device := range devices {
+		brightnessPath := filepath.Join(device, "brightness")
+		data, err := os.ReadFile(brightnessPath)
+		if err != nil {
+			lg.Error("Failed to read keyboard backlight", "device", device, "error", err.Error())
+			continue
+		}
+		brightness, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || brightness == 0 {
+			continue
+		}
+		if err := os.WriteFile(brightnessPath, []byte("0"), 0644); err != nil {
+			lg.Error("Failed to turn off keyboard backlight", "device", device, "error", err.Error())
+			continue
+		}
+		k.saved[device] = brightness
+	}
+}
+
+func (k *KeyboardBacklight) On() {
+	for device, brightness := range k.saved {
+		brightnessPath := filepath.Join(device, "brightness")
+		if err := os.WriteFile(brightnessPath, []byte(strconv.Itoa(brightness)), 0644); err != nil {
+			lg.Error("Failed to restore keyboard backlight", "device", device, "error", err.Error())
+		}
+		delete(k.saved, device)
+	}
+}
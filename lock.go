@@ -6,37 +6,40 @@ import (
 	"sync/atomic"
 	"time"
 
-	"golang.org/x/sys/unix"
-
 	"sync"
 	"syscall"
 
 	"github.com/trbjo/goidle/utilities"
 )
 
+type LockManager struct {
+	// StartUser starts the locker without a grace period.
+	StartUser func() bool
+	// StartIdle starts the locker, unlocking on input within the grace period.
+	StartIdle func() bool
+	// TryStop stops the locker if within the grace period and reports whether
+	// no locker is running anymore.
+	TryStop func() bool
+	// Stop stops the locker unconditionally, reason is reported to
+	// onLockChange.
+	Stop    func(reason string)
+	Running func() bool
+}
+
 func CreateLockManager(
-	config *Config,
-	LockChan chan<- LockStatus,
-) (func() bool, func() bool, func() bool) {
+	configState *SafeState[*Config],
+	state *RuntimeState,
+	clock Clock,
+	post func(Event),
+	onLockChange func(locked bool, reason string),
+) LockManager {
 	var mu sync.Mutex
-	var idleLockStartedAt unix.Timespec
+	var idleLockStartedAt time.Duration
 	var isLockRunning atomic.Int64
+	// unlockReason is how the running locker is being stopped
+	unlockReason := NewSafeState("")
 	LockStopRequest := make(chan bool)
 
-	getTimeDelta := func(currentTs, startTs unix.Timespec) time.Duration {
-		return (time.Duration(currentTs.Sec*1e9+currentTs.Nsec) - time.Duration(startTs.Sec*1e9+startTs.Nsec)).Round(time.Millisecond)
-	}
-
-	timeSinceBoot := func() unix.Timespec {
-		var ts unix.Timespec
-		err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts)
-		if err != nil {
-			lg.Error("Error getting current CLOCK_BOOTTIME", "error", err.Error())
-			os.Exit(128)
-		}
-		return ts
-	}
-
 	sendNonBlockingMessage := utilities.CreateNonBlockingSender(LockStopRequest)
 
 	start := func(userInitiated bool) bool {
@@ -45,18 +48,18 @@ func CreateLockManager(
 		}
 		mu.Lock()
 		defer mu.Unlock()
+		// the locker may be started from the sleep watcher as well
+		if isLockRunning.Load() != 0 {
+			return true
+		}
+		config := configState.Get()
 
 		if userInitiated {
-			idleLockStartedAt = unix.Timespec{
-				Sec:  timeSinceBoot().Sec - int64(config.IdleGraceDuration.Seconds()) - 1,
-				Nsec: 0,
-			}
+			idleLockStartedAt = clock.SinceBoot() - state.GraceDuration(config.IdleGraceDuration.Duration) - time.Second
 		} else {
-			idleLockStartedAt = timeSinceBoot()
+			idleLockStartedAt = clock.SinceBoot()
 		}
 
-		MusicStop()
-
 		lockCommand := exec.Command(config.LockCommand[0], config.LockCommand[1:]...)
 		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
 		if err != nil {
@@ -70,15 +73,28 @@ func CreateLockManager(
 			lg.Error("Error starting lockCommand", "error", err.Error())
 			return false
 		}
+		// paused only once the locker runs, so a broken lock_command does
+		// not leave the music paused
+		paused := MusicStop()
 
 		instanceId := int64(lockCommand.Process.Pid)
 		isLockRunning.Store(instanceId)
+		unlockReason.Set("password")
+		if userInitiated {
+			onLockChange(true, "user")
+		} else {
+			onLockChange(true, "idle")
+		}
 
 		go func() {
 			lockCommand.Wait()
 			sendNonBlockingMessage(false)
 			isLockRunning.Store(0)
-			LockChan <- LockExit
+			onLockChange(false, unlockReason.Get())
+			if config := configState.Get(); config.MediaResumeOnUnlock {
+				MusicResume(config, paused)
+			}
+			post(LockExit)
 		}()
 
 		go func() {
@@ -101,32 +117,30 @@ func CreateLockManager(
 		lg.Debug("unlock request for lockCommand")
 		mu.Lock()
 		defer mu.Unlock()
+		config := configState.Get()
 
-		if getTimeDelta(timeSinceBoot(), idleLockStartedAt) < config.IdleGraceDuration.Duration {
+		if (clock.SinceBoot() - idleLockStartedAt).Round(time.Millisecond) < state.GraceDuration(config.IdleGraceDuration.Duration) {
 			lg.Debug("TIMEOUT unlock")
+			unlockReason.Set("grace")
 			sendNonBlockingMessage(true)
 			return true
 		}
 
-		go NetWatcher(config.TrustedWifis, func(success bool) {
-			if isLockRunning.Load() != instanceId {
-				return
-			}
-
-			if success {
-				lg.Debug("before WIFI unlock")
-				sendNonBlockingMessage(true)
-				lg.Debug("after WIFI unlock")
-			} else {
-				LockChan <- UnlockFailed
-				lg.Debug("Not connected to trusted wifi")
-			}
-		})
-
-
 		lg.Debug("returning false, not unlocking")
 		return false
 	}
 
-	return func() bool { return start(true) }, func() bool { return start(false) }, tryStop
+	return LockManager{
+		StartUser: func() bool { return start(true) },
+		StartIdle: func() bool { return start(false) },
+		TryStop:   tryStop,
+		Stop: func(reason string) {
+			if isLockRunning.Load() != 0 {
+				lg.Debug("unconditional unlock request for lockCommand")
+				unlockReason.Set(reason)
+				sendNonBlockingMessage(true)
+			}
+		},
+		Running: func() bool { return isLockRunning.Load() != 0 },
+	}
 }
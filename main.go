@@ -1,13 +1,16 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/trbjo/goidle/logger"
+	"github.com/trbjo/goidle/power"
 	"github.com/trbjo/goidle/utilities"
 )
 
@@ -16,47 +19,61 @@ var lg = logger.Slog
 func setupIdleEvents(
 	SM *StateManager,
 	config *Config,
-	idleEventsFunc func(IdleEvent),
-	backlightFunc func(BackLight),
-	turnOffBacklight func(),
+	post func(Event),
 ) {
-	// Active state timeouts
-	SM.RegisterTimeout(Active, config.TimeoutActiveDim.Duration,
-		func() { backlightFunc(Dim) },
-		func() { backlightFunc(Restore) },
-	)
-
-	SM.RegisterTimeout(Active, config.TimeoutActiveToIdle.Duration,
-		func() { idleEventsFunc(IdleRequest) },
-		func() {},
-	)
-
-	// Idle state timeouts
-	SM.RegisterTimeoutOnce(Idle, 30*time.Millisecond,
-		func() {},
-		func() { idleEventsFunc(TryUnlock) },
-	)
+	timeline := config.EffectiveTimeline()
+	register := func(state StateValue, index int, stage Stage) {
+		var h *TimeoutHandler
+		h = SM.RegisterTimeout(state, stage.Timeout.Duration, stage.IgnoreInhibitors,
+			func() { post(StageEvent{State: state, Index: index, handler: h}) },
+			func() { post(StageEvent{State: state, Index: index, Resumed: true, handler: h}) },
+		)
+	}
 
-	SM.RegisterTimeout(Idle, config.TimeoutIdleBacklightOff.Duration,
-		func() { turnOffBacklight() },
-		func() { idleEventsFunc(TryUnlock) },
-	)
+	for i, stage := range timeline.Active {
+		register(Active, i, stage)
+	}
 
-	SM.RegisterTimeout(Idle, config.TimeoutIdleToSuspend.Duration,
-		func() { idleEventsFunc(TryIdleToSuspend) },
+	SM.RegisterTimeoutOnce(Idle, unlockProbe.Timeout.Duration,
 		func() {},
+		func() { post(StageEvent{State: Idle, Index: -1, Resumed: true}) },
 	)
+	for i, stage := range timeline.Idle {
+		register(Idle, i, stage)
+	}
 }
 
 func nop() bool { return true }
 
+// checkConfig validates the config at configPath without starting the daemon
+// and returns the process exit code.
+func checkConfig(configPath string) int {
+	logger.SetLogLevel("warn")
+	if _, err := loadConfig(configPath); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Printf("%s: ok\n", configPath)
+	return 0
+}
+
 func main() {
-	opm, err := NewOutputPowerManager()
-	if err != nil {
-		lg.Error("Failed to create OutputPowerManager", "error", err)
-		return
+	checkOnly := flag.Bool("check-config", false, "validate the config file and exit")
+	statusStream := flag.Bool("status-stream", false, "print the status of the running daemon on every change, for status bars")
+	format := flag.String("format", "waybar", "the `format` of --status-stream")
+	text := flag.String("template", defaultStatusTemplate, "the Go `template` of the text printed by --status-stream")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [--check-config [path]]\n       %s --status-stream [--format waybar] [--template TEMPLATE]\n       %s caffeinate DURATION|+DURATION|cancel\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *statusStream {
+		os.Exit(runStatusStream(*format, *text))
+	}
+	if !*checkOnly && flag.Arg(0) == "caffeinate" {
+		os.Exit(runCaffeinate(flag.Args()[1:]))
 	}
-	defer opm.Close()
 
 	configPath := os.Getenv("GOIDLE_CONFIG")
 	if configPath == "" {
@@ -64,127 +81,215 @@ func main() {
 		configPath = filepath.Join(home, "/.config/goidle.json")
 	}
 
-	config := initConfig(configPath)
+	if *checkOnly {
+		if flag.NArg() > 0 {
+			configPath = flag.Arg(0)
+		}
+		os.Exit(checkConfig(configPath))
+	}
 
-	lg.Info("Starting StateManager")
+	initialConfig, err := initConfig(configPath)
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			lg.Error(line)
+		}
+		lg.Error("Invalid config, not starting")
+		os.Exit(1)
+	}
+	baseConfig := initialConfig
+	powerStatus := power.ReadStatus(power.SysfsRoot)
+	config := NewSafeState(baseConfig.WithProfile(profileFor(powerStatus, baseConfig.BatteryLowPercent)))
+	state := LoadRuntimeState(runtimeStatePath(), initialConfig)
+
+	opm, err := NewOutputPowerManager()
+	if err != nil {
+		lg.Error("Failed to create OutputPowerManager", "error", err)
+		return
+	}
+	defer opm.Close()
 
-	idleEvents := make(chan IdleEvent)
-	lidEvents := make(chan LidEvent)
-	signalChannel := make(chan os.Signal, 1)
-	LockUnlockAttempt := make(chan LockStatus)
-	userRequests := make(chan UserRequest)
+	lg.Info("Starting StateManager", "profile", config.Get().profile)
 
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	events := NewEventQueue()
+	props := NewProperties(dbusPath)
+	dbusSignals := NewSignals(dbusInterface, dbusPath)
+	changed := func(names ...string) { props.Changed(dbusInterface, names...) }
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	idleManager, err := NewIdleManager(config.IdleSeat)
+	idleManager, err := NewIdleManager(config.Get().IdleSeat)
 	if err != nil {
 		lg.Error("Failed to create idle manager", "error", err.Error())
 		return
 	}
 	defer idleManager.Close()
-	SM := NewStateManager(idleManager)
+	SM := NewStateManager(idleManager, systemClock{})
+	SM.OnChange(func(old, new StateValue, reason string) {
+		changed("State")
+		dbusSignals.Emit("StateChanged", stateName(old), stateName(new), reason)
+	})
+
+	inhibitors := NewInhibitorRegistry(func(inhibited bool) {
+		changed("Inhibited")
+		if inhibited {
+			go events.Post(IdleInhibit)
+		} else {
+			go events.Post(IdleAllow)
+		}
+	})
+	if conn := dbusConnection(); conn != nil {
+		inhibitors.WatchOwners(conn)
+	}
+	inhibitors.OnUpdate(func() { changed("Inhibitors") })
+	caffeine := NewCaffeine(inhibitors, state, config)
+	caffeine.OnChange(func() { changed("CaffeineRemaining") })
+	media := WatchMedia(config, inhibitors)
+	screenSaver := setupScreenSaver(inhibitors, events.TryPost)
 
-	LockStartUser, LockStartIdle, LockStop := CreateLockManager(config, LockUnlockAttempt)
+	setLockedHint := CreateSessionWatcher(
+		func() { go events.Post(Lock) },
+		func() { go events.Post(Unlock) },
+	)
+	hooks := NewHookRunner(config, SM.ReadState, opm.ListOutputNames)
+	locker := CreateLockManager(config, state, systemClock{}, events.Post, func(locked bool, reason string) {
+		setLockedHint(locked)
+		screenSaver.SetLocked(locked)
+		// the network is checked on unlocking
+		changed("Locked", "TrustedNetwork")
+		if locked {
+			dbusSignals.Emit("Locked")
+			hooks.Run("on_lock", reason)
+		} else {
+			dbusSignals.Emit("Unlocked", reason)
+			hooks.Run("on_unlock", reason)
+		}
+	})
 	lidClosed := utilities.CreateLidChecker()
-	SuspendFunc := CreateSuspendFunc(lidClosed, config.SuspendCommand)
+	batteryMonitor := CreateBatteryMonitor(config, func() {
+		go events.Post(BatteryCritical)
+	})
 
-	backlightFunc, err := NewBacklight(config)
+	backlight, err := NewBacklight(config, func(brightness, max int) {
+		changed("Brightness")
+		dbusSignals.Emit("BrightnessChanged", uint32(brightness), uint32(max))
+	})
 	if err != nil {
 		lg.Error(err.Error())
 		return
 	}
 
-	backlightOff := func() {
-		opm.Off()
-		backlightFunc(Restore)
+	engine := &PolicyEngine{
+		Actuators: Actuators{
+			Outputs:   opm,
+			Backlight: backlight.Control,
+			Keyboard:  NewKeyboardBacklight(),
+			Locker:    locker,
+			NewSleeper: func(config *Config) Sleeper {
+				return Sleeper{
+					Suspend:                CreateSuspendFunc(lidClosed, config),
+					Hibernate:              CreateSystemdSleepFunc(lidClosed, "Hibernate"),
+					HybridSleep:            CreateSystemdSleepFunc(lidClosed, "HybridSleep"),
+					BatteryCritical:        CreateBatteryCriticalFunc(lidClosed, config.BatteryCriticalAction),
+					BatteryCriticalResumes: batteryCriticalResumes(config.BatteryCriticalAction),
+				}
+			},
+		},
+		SM:             SM,
+		clock:          systemClock{},
+		config:         config,
+		baseConfig:     baseConfig,
+		configPath:     configPath,
+		powerStatus:    powerStatus,
+		events:         events,
+		inhibitors:     inhibitors,
+		hooks:          hooks,
+		lidClosed:      lidClosed,
+		batteryMonitor: batteryMonitor,
+		refreshMedia:   media.Refresh,
+		changed:        changed,
+		emit:           dbusSignals.Emit,
+		checkNetwork: func(result func(trusted bool)) {
+			go NetWatcher(state.Trusted(), result)
+		},
 	}
 
+	requestReload := func() error {
+		result := make(chan error, 1)
+		events.Post(ReloadEvent{Result: result})
+		return <-result
+	}
+	request := func(req UserRequest) error {
+		result := make(chan error, 1)
+		events.Post(Request{UserRequest: req, Result: result})
+		return <-result
+	}
+
+	register := func(name string, get func() any) { props.Register(dbusInterface, name, get) }
+	register("State", func() any { return stateName(SM.ReadState()) })
+	register("Locked", func() any { return locker.Running() })
+	register("Inhibited", func() any { return inhibitors.Inhibited() })
+	register("Inhibitors", func() any { return inhibitorInfos(inhibitors.List()) })
+	register("Dimmed", func() any { return engine.Dimmed() })
+	register("OutputsOff", func() any { return engine.OutputsOff() })
+	register("Brightness", func() any { return uint32(backlight.Brightness()) })
+	register("MaxBrightness", func() any { return uint32(backlight.MaxBrightness()) })
+	register("OnBattery", func() any { return power.ReadStatus(power.SysfsRoot).OnBattery })
+	register("LidClosed", func() any { return lidClosed() })
+	register("Outputs", func() any { return opm.ListOutputNames() })
+	register("TrustedNetwork", func() any { return state.OnTrustedWifi() })
+	register("IdleGraceDuration", func() any {
+		return state.GraceDuration(config.Get().IdleGraceDuration.Duration).String()
+	})
+	register("CaffeineRemaining", func() any { return uint32(caffeine.Remaining().Seconds()) })
+	register("NextStage", func() any { return engine.NextStage().Action })
+	register("NextStageAt", func() any {
+		if at := engine.NextStage().At; !at.IsZero() {
+			return at.Unix()
+		}
+		return int64(0)
+	})
+
 	go setupDbus(
 		config,
+		state,
 		opm,
-		utilities.CreateNonBlockingSender(lidEvents),
-		utilities.CreateNonBlockingSender(userRequests),
-		backlightFunc,
+		events.TryPost,
+		backlight.Control,
+		requestReload,
+		request,
+		inhibitors,
+		caffeine,
+		props,
+		dbusSignals,
 	)
 
-	setupIdleEvents(SM, config, utilities.CreateNonBlockingSender(idleEvents), backlightFunc, backlightOff)
-	SM.SetState(Active, 0, nop)
-	go idleManager.Run()
-
-	for {
-		select {
-		case swRes := <-LockUnlockAttempt:
-			if swRes == LockExit {
-				lg.Debug("LockExit event", "", swRes.String())
-				SM.SetState(Active, 0, nop)
-			}
-			opm.On()
-		case lidEvent := <-lidEvents:
-			if lidClosed() == (lidEvent == LidClose) {
-				if lidEvent == LidOpen {
-					lg.Debug("got LidOpen event")
-					if SM.ReadState() == Active {
-						opm.On()
-					}
-				} else {
-					lg.Debug("got LidClose event")
-					if opm.NumOutputs() == 1 {
-						go func() { userRequests <- Suspend }()
-					} else {
-						backlightOff()
-					}
-				}
-			}
-		case res := <-idleEvents:
-			switch res {
-			case TryUnlock:
-				lg.Debug("got TryUnlock on idleEvents")
-				if !LockStop() {
-					opm.On()
-				}
-			case IdleRequest:
-				SM.SetState(Idle, config.LockInitIgnoreInputTimeout.Duration, func() bool {
-					backlightOff()
-					return LockStartIdle()
-				})
-			case TryIdleToSuspend:
-				SM.SetState(Idle, 0, func() bool {
-					// set or reset the idle state if the following shortcircuits:
-					// when the laptop is not connected to an external monitor or running on AC,
-					// this means that the idle state will loop with a timeout of 20 seconds (see above).
-					// this ensures that even at some later point, if the laptop gets (dis)connected to a
-					// power source/monitor we will react to those events.
-					return !(opm.NumOutputs() == 1 && utilities.OnBattery() && SuspendFunc() && LockStop())
-				})
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				lg.Info("got SIGHUP, reloading config")
+				events.Post(ReloadEvent{})
+			} else {
+				events.Post(ShutdownEvent{})
 			}
-		case res := <-userRequests:
-			lg.Debug("userRequests", "", res.String())
-			switch res {
-			case Lock:
-				SM.SetState(Idle, config.LockInitIgnoreInputTimeout.Duration, func() bool {
-					backlightOff()
-					return LockStartUser()
-				})
-			case Suspend:
-				SM.SetState(Idle, 0, func() bool {
-					backlightOff()
-					// set or reset the idle state if the following shortcircuits:
-					return !(LockStartIdle() && SuspendFunc() && LockStop())
-				})
-			case IdleInhibit:
-				if SM.ReadState() == Active {
-					SM.SetState(None, 0, nop)
-				}
-			case IdleAllow:
-				if SM.ReadState() == None {
-					SM.SetState(Active, 0, nop)
-				}
-			}
-		case <-signalChannel:
-			lg.Info("got shutdown signal")
-			SM.SetState(None, 0, nop)
-			config.Dump()
-			os.Exit(0)
 		}
-	}
+	}()
+	go ConfigWatcher(configPath, func() { events.Post(ReloadEvent{}) })
+	go SleepWatcher(engine.PrepareForSleep, engine.Resumed)
+	go func() {
+		err := power.Watch(power.SysfsRoot, func(status power.Status) {
+			changed("OnBattery")
+			events.TryPost(PowerEvent{Status: status})
+		})
+		if err != nil {
+			lg.Error("Failed to watch power supplies", "error", err.Error())
+		}
+	}()
+	opm.OnHotplug(func(name string, added bool) {
+		changed("Outputs")
+		events.TryPost(OutputEvent{Name: name, Added: added})
+	})
+
+	engine.Start()
+	go idleManager.Run()
+	engine.Run()
 }
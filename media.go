@@ -0,0 +1,261 @@
+package main
+
+import (
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	mprisPrefix      = "org.mpris.MediaPlayer2."
+	mprisPath        = "/org/mpris/MediaPlayer2"
+	mprisPlayerIface = "org.mpris.MediaPlayer2.Player"
+
+	// mediaOwner is the registry owner of the media inhibitor, see
+	// caffeineOwner.
+	mediaOwner = "goidle:media"
+
+	MediaAudioIdle = "idle"
+	MediaAudioLock = "lock"
+	MediaAudioNone = "none"
+)
+
+var mediaAudioModes = []string{MediaAudioIdle, MediaAudioLock, MediaAudioNone}
+
+// defaultVideoPlayers are players whose playback is assumed to be video. MPRIS
+// has no way to tell, so players not listed here count as video only when the
+// URL of the current track has a video extension.
+var defaultVideoPlayers = []string{"mpv", "vlc", "totem", "celluloid", "firefox", "chromium", "chrome", "brave"}
+
+var videoExtensions = []string{".mp4", ".mkv", ".webm", ".avi", ".mov", ".m4v", ".flv", ".wmv", ".mpg", ".mpeg", ".ogv"}
+
+type mediaPlayer struct {
+	// name is the player's bus name without the MPRIS prefix, e.g.
+	// "firefox.instance_1_42"
+	name    string
+	playing bool
+	url     string
+}
+
+// matchPlayer reports whether the player name matches one of names. An entry
+// matches the player of that name and all of its instances.
+func matchPlayer(names []string, name string) bool {
+	return slices.ContainsFunc(names, func(n string) bool {
+		return name == n || strings.HasPrefix(name, n+".")
+	})
+}
+
+func (p *mediaPlayer) isVideo(config *Config) bool {
+	if matchPlayer(config.MediaVideoPlayers, p.name) {
+		return true
+	}
+	return slices.Contains(videoExtensions, strings.ToLower(path.Ext(p.url)))
+}
+
+// MediaWatcher follows the PlaybackStatus of every MPRIS player and holds an
+// idle inhibitor while one of them is playing.
+type MediaWatcher struct {
+	mu         sync.Mutex
+	conn       *dbus.Conn
+	config     *SafeState[*Config]
+	inhibitors *InhibitorRegistry
+	// players is keyed by unique bus name, the sender of PropertiesChanged
+	players map[string]*mediaPlayer
+	cookie  uint32
+	kind    InhibitKind
+}
+
+func WatchMedia(config *SafeState[*Config], inhibitors *InhibitorRegistry) *MediaWatcher {
+	m := &MediaWatcher{
+		config:     config,
+		inhibitors: inhibitors,
+		players:    make(map[string]*mediaPlayer),
+	}
+
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		lg.Error("Failed to connect to session bus", "error", err.Error())
+		return m
+	}
+
+	matches := [][]dbus.MatchOption{
+		{
+			dbus.WithMatchObjectPath(mprisPath),
+			dbus.WithMatchInterface(propertiesInterface),
+			dbus.WithMatchMember("PropertiesChanged"),
+			dbus.WithMatchArg(0, mprisPlayerIface),
+		},
+		{
+			dbus.WithMatchSender("org.freedesktop.DBus"),
+			dbus.WithMatchMember("NameOwnerChanged"),
+			dbus.WithMatchArg0Namespace("org.mpris.MediaPlayer2"),
+		},
+	}
+	for _, match := range matches {
+		if err := conn.AddMatchSignal(match...); err != nil {
+			lg.Error("Failed to add match for signal", "error", err.Error())
+			conn.Close()
+			return m
+		}
+	}
+	m.conn = conn
+
+	signalChan := make(chan *dbus.Signal, 16)
+	conn.Signal(signalChan)
+
+	var names []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListNames", 0).Store(&names); err != nil {
+		lg.Error("Failed to list bus names", "error", err.Error())
+	}
+
+	m.mu.Lock()
+	for _, name := range names {
+		if strings.HasPrefix(name, mprisPrefix) {
+			m.addPlayer(name)
+		}
+	}
+	m.sync()
+	m.mu.Unlock()
+
+	go func() {
+		for signal := range signalChan {
+			m.mu.Lock()
+			m.handle(signal)
+			m.sync()
+			m.mu.Unlock()
+		}
+	}()
+	return m
+}
+
+// Refresh re-evaluates the players against the current config.
+func (m *MediaWatcher) Refresh() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sync()
+}
+
+// addPlayer looks up the owner and playback state of a newly seen player. It
+// must be called with the lock held.
+func (m *MediaWatcher) addPlayer(name string) {
+	var owner string
+	if err := m.conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, name).Store(&owner); err != nil {
+		lg.Debug("Failed to get owner of media player", "player", name, "error", err.Error())
+		return
+	}
+
+	player := &mediaPlayer{name: strings.TrimPrefix(name, mprisPrefix)}
+	obj := m.conn.Object(owner, mprisPath)
+	if status, err := obj.GetProperty(mprisPlayerIface + ".PlaybackStatus"); err == nil {
+		player.playing = status.Value() == "Playing"
+	} else {
+		lg.Debug("Failed to get PlaybackStatus", "player", name, "error", err.Error())
+	}
+	if metadata, err := obj.GetProperty(mprisPlayerIface + ".Metadata"); err == nil {
+		player.setMetadata(metadata)
+	}
+	m.players[owner] = player
+	lg.Debug("Watching media player", "player", player.name, "playing", player.playing)
+}
+
+func (p *mediaPlayer) setMetadata(metadata dbus.Variant) {
+	values, ok := metadata.Value().(map[string]dbus.Variant)
+	if !ok {
+		return
+	}
+	p.url, _ = values["xesam:url"].Value().(string)
+}
+
+// handle applies a signal to the players. It must be called with the lock
+// held.
+func (m *MediaWatcher) handle(signal *dbus.Signal) {
+	switch signal.Name {
+	case propertiesInterface + ".PropertiesChanged":
+		player, ok := m.players[signal.Sender]
+		if !ok || len(signal.Body) < 2 {
+			return
+		}
+		changed, ok := signal.Body[1].(map[string]dbus.Variant)
+		if !ok {
+			return
+		}
+		if status, ok := changed["PlaybackStatus"]; ok {
+			player.playing = status.Value() == "Playing"
+			lg.Debug("Media player status changed", "player", player.name, "playing", player.playing)
+		}
+		if metadata, ok := changed["Metadata"]; ok {
+			player.setMetadata(metadata)
+		}
+	case "org.freedesktop.DBus.NameOwnerChanged":
+		if len(signal.Body) != 3 {
+			return
+		}
+		name, _ := signal.Body[0].(string)
+		oldOwner, _ := signal.Body[1].(string)
+		newOwner, _ := signal.Body[2].(string)
+		if !strings.HasPrefix(name, mprisPrefix) {
+			return
+		}
+		if oldOwner != "" {
+			delete(m.players, oldOwner)
+		}
+		if newOwner != "" {
+			m.addPlayer(name)
+		}
+	}
+}
+
+// sync takes, changes or releases the media inhibitor to match the players.
+// It must be called with the lock held.
+func (m *MediaWatcher) sync() {
+	config := m.config.Get()
+
+	inhibit := false
+	kind := InhibitLock
+	app := ""
+	if config.MediaInhibit {
+		for _, player := range m.players {
+			if !player.playing || matchPlayer(config.MediaIgnorePlayers, player.name) {
+				continue
+			}
+			if len(config.MediaPlayers) > 0 && !matchPlayer(config.MediaPlayers, player.name) {
+				continue
+			}
+
+			playerKind := InhibitIdle
+			if !player.isVideo(config) {
+				if config.MediaAudioInhibit == MediaAudioNone {
+					continue
+				}
+				if config.MediaAudioInhibit == MediaAudioLock {
+					playerKind = InhibitLock
+				}
+			}
+			if !inhibit || playerKind == InhibitIdle {
+				inhibit, kind, app = true, playerKind, player.name
+			}
+		}
+	}
+
+	if inhibit == (m.cookie != 0) && (!inhibit || kind == m.kind) {
+		return
+	}
+
+	// add the new inhibitor before releasing the old one, see Caffeine.Set
+	old := m.cookie
+	m.cookie = 0
+	if inhibit {
+		if kind == InhibitIdle {
+			m.cookie = m.inhibitors.Add(mediaOwner, app, "playing media", 0)
+		} else {
+			m.cookie = m.inhibitors.AddLock(mediaOwner, app, "playing audio")
+		}
+		m.kind = kind
+	}
+	if old != 0 {
+		m.inhibitors.Remove(old)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -11,13 +13,17 @@ import (
 )
 
 type OutputPowerManager struct {
-	display  *client.Display
-	registry *client.Registry
-	manager  *wlroutput.OutputPowerManagerV1
-	outputs  map[string]*outputInfo
-	mu	   sync.Mutex
-	running  bool
-	stopCh   chan struct{}
+	display   *client.Display
+	registry  *client.Registry
+	manager   *wlroutput.OutputPowerManagerV1
+	outputs   map[string]*outputInfo
+	mu        sync.Mutex
+	running   bool
+	stopCh    chan struct{}
+	onHotplug func(name string, added bool)
+	// previous holds the outputs of the lost connection while reconnecting,
+	// they are not reported as added again
+	previous map[string]*outputInfo
 }
 
 type outputInfo struct {
@@ -135,11 +141,16 @@ func (opm *OutputPowerManager) setupOutput(output *client.Output) {
 
 	output.SetNameHandler(func(e client.OutputNameEvent) {
 		opm.mu.Lock()
-		defer opm.mu.Unlock()
-
 		info.name = e.Name
 		opm.outputs[e.Name] = info
+		_, known := opm.previous[e.Name]
+		onHotplug := opm.onHotplug
+		opm.mu.Unlock()
+
 		lg.Debug(fmt.Sprintf("Added output: %s", e.Name))
+		if onHotplug != nil && !known {
+			onHotplug(e.Name, true)
+		}
 	})
 
 	outputPower.SetModeHandler(func(e wlroutput.OutputPowerV1ModeEvent) {
@@ -158,12 +169,24 @@ func (opm *OutputPowerManager) setupOutput(output *client.Output) {
 
 func (opm *OutputPowerManager) removeOutput(name string) {
 	opm.mu.Lock()
-	defer opm.mu.Unlock()
-
-	if info, ok := opm.outputs[name]; ok {
+	info, ok := opm.outputs[name]
+	if ok {
 		info.power.Destroy()
 		delete(opm.outputs, name)
 	}
+	onHotplug := opm.onHotplug
+	opm.mu.Unlock()
+
+	if ok && onHotplug != nil {
+		onHotplug(name, false)
+	}
+}
+
+// OnHotplug sets a function called when an output is added or removed.
+func (opm *OutputPowerManager) OnHotplug(fn func(name string, added bool)) {
+	opm.mu.Lock()
+	defer opm.mu.Unlock()
+	opm.onHotplug = fn
 }
 
 func (opm *OutputPowerManager) NumOutputs() int {
@@ -229,13 +252,17 @@ func (opm *OutputPowerManager) action(mode wlroutput.OutputPowerV1Mode) {
 	}
 }
 
-func (opm *OutputPowerManager) ToggleOutput(name string) error {
+// ErrNoSuchOutput is returned for output names that are not connected.
+var ErrNoSuchOutput = errors.New("no such output")
+
+// ToggleOutput turns an output on or off and returns whether it was turned on.
+func (opm *OutputPowerManager) ToggleOutput(name string) (bool, error) {
 	opm.mu.Lock()
 	defer opm.mu.Unlock()
 
 	info, ok := opm.outputs[name]
 	if !ok {
-		return fmt.Errorf("output %s not found", name)
+		return false, fmt.Errorf("%w: %s", ErrNoSuchOutput, name)
 	}
 
 	var newMode wlroutput.OutputPowerV1Mode
@@ -247,14 +274,15 @@ func (opm *OutputPowerManager) ToggleOutput(name string) error {
 
 	err := info.power.SetMode(uint32(newMode))
 	if err != nil {
-		return fmt.Errorf("failed to set output power mode for %s: %w", name, err)
+		return false, fmt.Errorf("failed to set output power mode for %s: %w", name, err)
 	}
 
 	// The actual mode change will be confirmed by the SetModeHandler
 
-	return nil
+	return newMode == wlroutput.OutputPowerV1ModeOn, nil
 }
 
+// ListOutputNames returns the names of the outputs, sorted.
 func (opm *OutputPowerManager) ListOutputNames() []string {
 	opm.mu.Lock()
 	defer opm.mu.Unlock()
@@ -263,6 +291,7 @@ func (opm *OutputPowerManager) ListOutputNames() []string {
 	for name := range opm.outputs {
 		names = append(names, name)
 	}
+	slices.Sort(names)
 	return names
 }
 
@@ -274,15 +303,18 @@ func (opm *OutputPowerManager) StartEventLoop() {
 	}
 	opm.running = true
 	opm.stopCh = make(chan struct{})
+	// a reconnect replaces the display, this loop stays with the old one
+	stopCh := opm.stopCh
+	display := opm.display
 	opm.mu.Unlock()
 
 	go func() {
 		for {
 			select {
-			case <-opm.stopCh:
+			case <-stopCh:
 				return
 			default:
-				opm.display.Context().Dispatch()
+				display.Context().Dispatch()
 			}
 		}
 	}()
@@ -298,8 +330,6 @@ func (opm *OutputPowerManager) StopEventLoop() {
 	opm.running = false
 }
 
-
-
 func (opm *OutputPowerManager) Close() {
 	opm.StopEventLoop()
 
@@ -329,9 +359,35 @@ func (opm *OutputPowerManager) reconnect() error {
 		return err
 	}
 
+	opm.mu.Lock()
 	opm.display = display
 	opm.registry = registry
+	opm.previous = opm.outputs
 	opm.outputs = make(map[string]*outputInfo)
+	opm.mu.Unlock()
+
+	err = opm.initialize()
 
-	return opm.initialize()
+	// report the outputs that vanished while disconnected
+	opm.mu.Lock()
+	var removed []string
+	for name := range opm.previous {
+		if _, ok := opm.outputs[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	opm.previous = nil
+	onHotplug := opm.onHotplug
+	opm.mu.Unlock()
+	if onHotplug != nil {
+		for _, name := range removed {
+			onHotplug(name, false)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	opm.StartEventLoop()
+	return nil
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/trbjo/goidle/wlroutput"
+)
+
+type hotplug struct {
+	name  string
+	added bool
+}
+
+// watchHotplug returns a function that expects the next hotplug events of opm
+// to be want, in any order, and no others.
+func watchHotplug(t *testing.T, opm *OutputPowerManager) func(want ...hotplug) {
+	events := make(chan hotplug, 8)
+	opm.OnHotplug(func(name string, added bool) { events <- hotplug{name, added} })
+	return func(want ...hotplug) {
+		t.Helper()
+		var got []hotplug
+		for len(got) < len(want) {
+			select {
+			case ev := <-events:
+				got = append(got, ev)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("hotplug events %+v, want %+v", got, want)
+			}
+		}
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if len(got) != len(want) {
+			t.Fatalf("hotplug events %+v, want %+v", got, want)
+		}
+		for _, w := range want {
+			if !slices.Contains(got, w) {
+				t.Fatalf("hotplug events %+v, want %+v", got, want)
+			}
+		}
+	}
+}
+
+func TestOutputPowerManagerHotplug(t *testing.T) {
+	srv := newFakeCompositor(t, 2)
+	srv.AddOutput("eDP-1")
+
+	opm, err := NewOutputPowerManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opm.Close()
+	if n := opm.NumOutputs(); n != 1 {
+		t.Fatalf("NumOutputs() = %d, want 1", n)
+	}
+	expect := watchHotplug(t, opm)
+
+	srv.AddOutput("DP-1")
+	expect(hotplug{"DP-1", true})
+	srv.waitFor("two outputs", func() bool { return opm.NumOutputs() == 2 })
+
+	opm.Off()
+	srv.waitFor("outputs off", func() bool {
+		eDP, _ := srv.Mode("eDP-1")
+		DP, _ := srv.Mode("DP-1")
+		return eDP == outputPowerOff && DP == outputPowerOff
+	})
+
+	srv.RemoveOutput("DP-1")
+	expect(hotplug{"DP-1", false})
+	if n := opm.NumOutputs(); n != 1 {
+		t.Fatalf("NumOutputs() = %d after unplugging, want 1", n)
+	}
+}
+
+func TestOutputPowerManagerReconnect(t *testing.T) {
+	srv := newFakeCompositor(t, 2)
+	srv.AddOutput("eDP-1")
+	srv.AddOutput("DP-1")
+
+	opm, err := NewOutputPowerManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opm.Close()
+	expect := watchHotplug(t, opm)
+
+	srv.DropClients()
+	// while disconnected DP-1 is unplugged and HDMI-A-1 plugged in
+	srv.RemoveOutput("DP-1")
+	srv.AddOutput("HDMI-A-1")
+	// writing to the dropped connection fails, action reconnects and retries
+	opm.Off()
+	// eDP-1 stayed connected and is not reported
+	expect(hotplug{"HDMI-A-1", true}, hotplug{"DP-1", false})
+
+	if n := srv.NumClients(); n != 1 {
+		t.Fatalf("%d clients after reconnecting, want 1", n)
+	}
+	if n := opm.NumOutputs(); n != 2 {
+		t.Fatalf("NumOutputs() = %d after reconnecting, want 2", n)
+	}
+	srv.waitFor("eDP-1 off", func() bool {
+		mode, _ := srv.Mode("eDP-1")
+		return mode == outputPowerOff
+	})
+
+	// the events of the new connection are dispatched
+	srv.waitFor("mode event", func() bool {
+		opm.mu.Lock()
+		defer opm.mu.Unlock()
+		info, ok := opm.outputs["eDP-1"]
+		return ok && info.mode == wlroutput.OutputPowerV1ModeOff
+	})
+	if on, err := opm.ToggleOutput("eDP-1"); err != nil || !on {
+		t.Fatalf("ToggleOutput returned %v, %v, want true", on, err)
+	}
+	if _, err := opm.ToggleOutput("DP-1"); !errors.Is(err, ErrNoSuchOutput) {
+		t.Errorf("toggling an unplugged output returned %v, want ErrNoSuchOutput", err)
+	}
+	srv.waitFor("eDP-1 on", func() bool {
+		mode, _ := srv.Mode("eDP-1")
+		return mode == outputPowerOn
+	})
+}
+
+func TestOutputPowerManagerFailed(t *testing.T) {
+	srv := newFakeCompositor(t, 2)
+	srv.AddOutput("eDP-1")
+	srv.AddOutput("DP-1")
+
+	opm, err := NewOutputPowerManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer opm.Close()
+	expect := watchHotplug(t, opm)
+
+	srv.Failed("DP-1")
+	expect(hotplug{"DP-1", false})
+	if names := opm.ListOutputNames(); !slices.Equal(names, []string{"eDP-1"}) {
+		t.Fatalf("outputs %q after DP-1 failed, want eDP-1", names)
+	}
+
+	opm.Off()
+	srv.waitFor("eDP-1 off", func() bool {
+		mode, _ := srv.Mode("eDP-1")
+		return mode == outputPowerOff
+	})
+	if mode, _ := srv.Mode("DP-1"); mode != outputPowerOn {
+		t.Error("the failed output was turned off")
+	}
+}
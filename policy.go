@@ -0,0 +1,629 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/trbjo/goidle/power"
+)
+
+// Errors of the user requests.
+var (
+	ErrLockerFailed  = errors.New("the screen locker failed to start")
+	ErrSuspendFailed = errors.New("the system failed to sleep")
+)
+
+// Outputs turns the outputs on and off. OutputPowerManager implements it.
+type Outputs interface {
+	On()
+	Off()
+	NumOutputs() int
+	ListOutputNames() []string
+}
+
+// Sleeper puts the machine to sleep, each function reporting whether it
+// slept. BatteryCritical is nil when no battery_critical_action is set.
+type Sleeper struct {
+	Suspend         func() bool
+	Hibernate       func() bool
+	HybridSleep     func() bool
+	BatteryCritical func() bool
+	// BatteryCriticalResumes is false for poweroff and commands, which return
+	// before the system goes down, so the locker must not be stopped after
+	BatteryCriticalResumes bool
+}
+
+// NextStage is the stage of the current timeline that runs next unless input
+// arrives.
+type NextStage struct {
+	// Action is empty when no stage is left
+	Action string
+	// At is the earliest time the stage runs, input not ending a stage goes
+	// unnoticed and pushes it back
+	At time.Time
+}
+
+// Actuators are what the PolicyEngine acts on.
+type Actuators struct {
+	Outputs   Outputs
+	Backlight func(BackLight)
+	Keyboard  *KeyboardBacklight
+	Locker    LockManager
+	// NewSleeper creates the Sleeper for a config, it is recreated when the
+	// config changes
+	NewSleeper func(config *Config) Sleeper
+}
+
+// PolicyEngine decides what happens on every Event. It consumes one queue, so
+// new event sources only need the queue's Post, and handles one event at a
+// time, so its handlers need no locking.
+//
+// The states are those of the StateManager: Active runs the active timeline,
+// Idle is locked and runs the idle timeline, None is idle inhibited.
+//
+//	event                        state   transition
+//	StageEvent timeout           stage   run the stage action, or mark it pending if its
+//	                                     conditions do not hold
+//	StageEvent resumed           stage   run the stage resume action
+//	StageEvent unlock probe      Idle    unlock within the grace period, else check the
+//	                                     network
+//	UserRequest Lock             any     outputs off, lock without grace period -> Idle
+//	UserRequest Suspend etc.     any     outputs off, lock, sleep, unlock within grace -> Idle
+//	UserRequest BatteryCritical  any     like Suspend with battery_critical_action,
+//	                                     poweroff and commands never unlock
+//	UserRequest Unlock           any     stop the locker
+//	UserRequest IdleInhibit      Active  -> None
+//	UserRequest IdleAllow        None    -> Active, lock if a deferred lock is released
+//	LockStatus LockExit          any     -> Active or None, outputs on
+//	NetworkEvent trusted         locked  stop the locker
+//	NetworkEvent untrusted       locked  outputs on to show the locker
+//	LidEvent LidClose            any     suspend with a single output, else outputs off
+//	LidEvent LidOpen             Active  outputs on
+//	PowerEvent                   any     switch the profile, check the battery
+//	OutputEvent                  any     none besides retrying pending stages
+//	SleepEvent SleepResumed      any     -> Idle if still locked
+//	ReloadEvent                  any     reload the config, keeping the state
+//	ShutdownEvent                any     -> None and exit
+//
+// Pending stages are retried on every LidEvent, PowerEvent and OutputEvent.
+type PolicyEngine struct {
+	Actuators
+
+	SM          *StateManager
+	clock       Clock
+	config      *SafeState[*Config]
+	baseConfig  *Config
+	configPath  string
+	powerStatus power.Status
+	events      EventQueue
+
+	inhibitors     *InhibitorRegistry
+	hooks          *HookRunner
+	lidClosed      func() bool
+	batteryMonitor func(power.Status)
+	refreshMedia   func()
+	// changed reports the D-Bus properties that changed
+	changed func(names ...string)
+	// emit emits a D-Bus signal
+	emit func(signal string, args ...any)
+	// checkNetwork reports, usually asynchronously, whether the machine is
+	// on a trusted network
+	checkNetwork func(result func(trusted bool))
+
+	sleeper       Sleeper
+	outputsAreOff atomic.Bool
+	dimmed        atomic.Bool
+	sleepHooksRan atomic.Bool
+	// lockDeferred is set when the screen was turned off instead of locked
+	// because only the lock is inhibited
+	lockDeferred bool
+	// pending holds the stages whose timeout passed while their conditions
+	// did not hold. They are retried after another timeout and right away
+	// when the lid, the power source or the outputs change.
+	pending map[StageEvent]struct{}
+	// idleSince is when the timeouts last started counting because a stage
+	// ran or ended
+	idleSince time.Duration
+	nextStage SafeState[NextStage]
+	// nextDeadline is the time since boot nextStage was computed for
+	nextDeadline time.Duration
+}
+
+// Start registers the timeline and enters the first state.
+func (p *PolicyEngine) Start() {
+	p.pending = make(map[StageEvent]struct{})
+	p.sleeper = p.withSleepHooks(p.NewSleeper(p.config.Get()))
+	setupIdleEvents(p.SM, p.config.Get(), p.events.TryPost)
+	p.activate("start")
+	p.batteryMonitor(p.powerStatus)
+	p.updateNextStage()
+}
+
+func (p *PolicyEngine) Run() {
+	for ev := range p.events {
+		p.Handle(ev)
+	}
+}
+
+// Handle applies the transition for an event.
+func (p *PolicyEngine) Handle(ev Event) {
+	switch ev := ev.(type) {
+	case StageEvent:
+		p.handleStage(ev)
+	case UserRequest:
+		p.handleUserRequest(ev)
+	case Request:
+		ev.Result <- p.handleUserRequest(ev.UserRequest)
+	case LockStatus:
+		p.handleLockStatus(ev)
+	case NetworkEvent:
+		p.handleNetwork(ev)
+	case LidEvent:
+		p.handleLid(ev)
+	case PowerEvent:
+		p.handlePower(ev.Status)
+	case OutputEvent:
+		lg.Debug("output changed", "output", ev.Name, "added", ev.Added)
+		p.retryPending()
+	case SleepEvent:
+		p.handleSleepResumed()
+	case ReloadEvent:
+		err := p.reload()
+		if ev.Result != nil {
+			ev.Result <- err
+		}
+	case ShutdownEvent:
+		lg.Info("got shutdown signal")
+		p.SM.SetState(None, "shutdown", 0, nop)
+		os.Exit(0)
+	default:
+		lg.Warn("Unhandled event", "event", fmt.Sprintf("%T", ev))
+	}
+	p.updateNextStage()
+}
+
+// Dimmed reports whether the screen is dimmed.
+func (p *PolicyEngine) Dimmed() bool {
+	return p.dimmed.Load()
+}
+
+// OutputsOff reports whether goidle turned the outputs off.
+func (p *PolicyEngine) OutputsOff() bool {
+	return p.outputsAreOff.Load()
+}
+
+func (p *PolicyEngine) NextStage() NextStage {
+	return p.nextStage.Get()
+}
+
+// updateNextStage finds the next stage of the current state, counting from
+// whichever came last of the timeouts being armed and a stage running or
+// ending.
+func (p *PolicyEngine) updateNextStage() {
+	var stages []Stage
+	switch p.SM.ReadState() {
+	case Active:
+		stages = p.config.Get().EffectiveTimeline().Active
+	case Idle:
+		stages = p.config.Get().EffectiveTimeline().Idle
+	}
+	now := p.clock.SinceBoot()
+	since := max(p.idleSince, p.SM.ArmedAt())
+	var next *Stage
+	for i, stage := range stages {
+		if stage.Timeout.Duration > now-since && (next == nil || stage.Timeout.Duration < next.Timeout.Duration) {
+			next = &stages[i]
+		}
+	}
+
+	var action string
+	var deadline time.Duration
+	if next != nil {
+		action = next.Action.Name
+		if action == "" {
+			action = "command"
+		}
+		deadline = since + next.Timeout.Duration
+	}
+	if action == p.nextStage.Get().Action && deadline == p.nextDeadline {
+		return
+	}
+	p.nextDeadline = deadline
+	ns := NextStage{Action: action}
+	if next != nil {
+		ns.At = time.Now().Add(deadline - now).Truncate(time.Second)
+	}
+	p.nextStage.Set(ns)
+	p.changed("NextStage", "NextStageAt")
+}
+
+// activate returns to the Active state, or to None while idle is inhibited
+func (p *PolicyEngine) activate(reason string) {
+	if p.inhibitors.Inhibited() {
+		p.SM.SetState(None, reason, 0, nop)
+	} else {
+		p.SM.SetState(Active, reason, 0, nop)
+	}
+}
+
+// outputsOff and outputsOn run the outputs hooks when the outputs actually
+// change, Outputs.On is also used to make sure they are on
+func (p *PolicyEngine) outputsOff(reason string) {
+	p.Outputs.Off()
+	p.Backlight(Restore)
+	if p.dimmed.Swap(false) {
+		p.changed("Dimmed")
+	}
+	if !p.outputsAreOff.Swap(true) {
+		p.hooks.Run("on_outputs_off", reason)
+		p.emit("OutputsOff")
+		p.changed("OutputsOff")
+	}
+}
+
+func (p *PolicyEngine) outputsOn(reason string) {
+	p.Outputs.On()
+	if p.outputsAreOff.Swap(false) {
+		p.hooks.Run("on_outputs_on", reason)
+		p.emit("OutputsOn")
+		p.changed("OutputsOff")
+	}
+}
+
+// withSleepHooks runs before_sleep ahead of the sleep functions and marks the
+// sleep as started by goidle, so before_sleep is not run again when logind
+// announces it
+func (p *PolicyEngine) withSleepHooks(s Sleeper) Sleeper {
+	wrap := func(reason string, sleep func() bool) func() bool {
+		return func() bool {
+			p.hooks.RunSync("before_sleep", reason)
+			p.sleepHooksRan.Store(true)
+			if !sleep() {
+				p.sleepHooksRan.Store(false)
+				return false
+			}
+			return true
+		}
+	}
+	s.Suspend = wrap(ActionSuspend, s.Suspend)
+	s.Hibernate = wrap(ActionHibernate, s.Hibernate)
+	s.HybridSleep = wrap(ActionHybridSleep, s.HybridSleep)
+	if s.BatteryCritical != nil {
+		s.BatteryCritical = wrap("battery_critical", s.BatteryCritical)
+	}
+	return s
+}
+
+// PrepareForSleep is called by the SleepWatcher before the system sleeps. It
+// runs outside the queue as the system waits for it.
+func (p *PolicyEngine) PrepareForSleep() {
+	if !p.sleepHooksRan.Swap(false) {
+		p.hooks.RunSync("before_sleep", "system")
+	}
+	p.emit("PrepareForSleep", true)
+	p.Locker.StartIdle()
+	p.outputsOff("sleep")
+}
+
+// Resumed is called by the SleepWatcher after the system resumed.
+func (p *PolicyEngine) Resumed() {
+	p.hooks.Run("after_resume", "resume")
+	p.emit("PrepareForSleep", false)
+	p.events.TryPost(SleepResumed)
+}
+
+// applyConfig activates the profile for the current power status on top of
+// baseConfig and re-registers the timeouts, keeping the current state.
+func (p *PolicyEngine) applyConfig() {
+	newConfig := p.baseConfig.WithProfile(profileFor(p.powerStatus, p.baseConfig.BatteryLowPercent))
+	p.config.Set(newConfig)
+	p.sleeper = p.withSleepHooks(p.NewSleeper(newConfig))
+	p.refreshMedia()
+	p.SM.ReplaceTimeouts(func() {
+		setupIdleEvents(p.SM, newConfig, p.events.TryPost)
+	})
+	p.changed("IdleGraceDuration")
+}
+
+func (p *PolicyEngine) reload() error {
+	newConfig, err := loadConfig(p.configPath)
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			lg.Error(line)
+		}
+		lg.Error("Config reload failed, keeping current config")
+		return err
+	}
+	if newConfig.IdleSeat != p.baseConfig.IdleSeat {
+		lg.Warn("idle_seat changed, restart goidle for it to take effect")
+	}
+
+	p.baseConfig = newConfig
+	p.applyConfig()
+	lg.Info("Config reloaded", "path", p.configPath, "profile", p.config.Get().profile)
+	return nil
+}
+
+func (p *PolicyEngine) lockIdle() {
+	p.lockDeferred = false
+	if p.inhibitors.LockInhibited() {
+		lg.Debug("lock inhibited, only turning off the screen")
+		p.lockDeferred = true
+		p.outputsOff("lock_inhibited")
+		return
+	}
+	p.SM.SetState(Idle, "idle", p.config.Get().LockInitIgnoreInputTimeout.Duration, func() bool {
+		p.outputsOff("idle")
+		return p.Locker.StartIdle()
+	})
+}
+
+// tryUnlock stops the locker within the grace period. Otherwise the network
+// is checked and a NetworkEvent decides.
+func (p *PolicyEngine) tryUnlock() bool {
+	if p.Locker.TryStop() {
+		return true
+	}
+	p.emit("UnlockFailed")
+	p.checkNetwork(func(trusted bool) {
+		p.events.TryPost(NetworkEvent{Trusted: trusted})
+	})
+	return false
+}
+
+// sleep locks unless already locked, sleeps and unlocks within the grace
+// period, staying Idle while locked.
+func (p *PolicyEngine) sleep(locked bool, reason string, sleepFunc func() bool) error {
+	var err error
+	slept := func() bool {
+		if !sleepFunc() {
+			err = ErrSuspendFailed
+			return false
+		}
+		return true
+	}
+	if locked {
+		// set or reset the idle state if the following shortcircuits:
+		p.SM.SetState(Idle, reason, 0, func() bool { return !(slept() && p.tryUnlock()) })
+		return err
+	}
+	p.SM.SetState(Idle, reason, 0, func() bool {
+		p.outputsOff(reason)
+		if !p.Locker.StartIdle() {
+			err = ErrLockerFailed
+			return true
+		}
+		return !(slept() && p.tryUnlock())
+	})
+	return err
+}
+
+// shutdown locks unless already locked and runs off, which does not resume,
+// so the locker keeps running.
+func (p *PolicyEngine) shutdown(reason string, off func() bool) error {
+	var err error
+	p.SM.SetState(Idle, reason, 0, func() bool {
+		p.outputsOff(reason)
+		if !p.Locker.StartIdle() {
+			err = ErrLockerFailed
+			return true
+		}
+		if !off() {
+			err = ErrSuspendFailed
+		}
+		return true
+	})
+	return err
+}
+
+func (p *PolicyEngine) checkCondition(condition string) bool {
+	switch condition {
+	case ConditionOnBattery:
+		return p.powerStatus.OnBattery
+	case ConditionSingleOutput:
+		return p.Outputs.NumOutputs() == 1
+	case ConditionLidClosed:
+		return p.lidClosed()
+	default:
+		return false
+	}
+}
+
+func (p *PolicyEngine) runAction(state StateValue, action Action) {
+	if len(action.Command) > 0 {
+		runStageCommand(action)
+		return
+	}
+	switch action.Name {
+	case ActionDim:
+		p.Backlight(Dim)
+		p.dimmed.Store(true)
+		p.hooks.Run("on_dim", "idle")
+		p.emit("Dimmed")
+		p.changed("Dimmed")
+	case ActionUndim:
+		p.Backlight(Restore)
+		p.dimmed.Store(false)
+		p.hooks.Run("on_undim", "input")
+		p.emit("Undimmed")
+		p.changed("Dimmed")
+	case ActionLock:
+		p.lockIdle()
+	case ActionUnlock:
+		clear(p.pending)
+		if !p.tryUnlock() {
+			p.outputsOn("input")
+		}
+	case ActionOutputsOff:
+		p.outputsOff("idle")
+	case ActionOutputsOn:
+		p.outputsOn("timeline")
+	case ActionKeyboardBacklightOff:
+		p.Keyboard.Off()
+	case ActionKeyboardBacklightOn:
+		p.Keyboard.On()
+	case ActionSuspend:
+		p.sleep(state == Idle, "sleep", p.sleeper.Suspend)
+	case ActionHibernate:
+		p.sleep(state == Idle, "sleep", p.sleeper.Hibernate)
+	case ActionHybridSleep:
+		p.sleep(state == Idle, "sleep", p.sleeper.HybridSleep)
+	}
+}
+
+func (p *PolicyEngine) handleStage(ev StageEvent) {
+	key := StageEvent{State: ev.State, Index: ev.Index}
+	stage, ok := p.config.Get().EffectiveTimeline().Stage(ev.State, ev.Index)
+	if !ok || p.SM.ReadState() != ev.State {
+		return
+	}
+	if ev.Resumed {
+		p.idleSince = p.clock.SinceBoot()
+		delete(p.pending, key)
+		if stage.Action.Name == ActionLock && p.lockDeferred {
+			p.lockDeferred = false
+			p.outputsOn("input")
+		}
+		p.runAction(ev.State, stage.Resume)
+		return
+	}
+	p.idleSince = p.clock.SinceBoot() - stage.Timeout.Duration
+	if !conditionsMet(stage.When, p.checkCondition) {
+		// e.g. when the laptop is connected to an external monitor or
+		// running on AC, the suspend stage loops with its timeout. This
+		// ensures that if the laptop gets disconnected from a monitor we
+		// will react to it.
+		lg.Debug("stage conditions not met, retrying later", "state", ev.State.String(), "stage", ev.Index)
+		p.pending[key] = struct{}{}
+		p.SM.Rearm(ev.handler)
+		return
+	}
+	delete(p.pending, key)
+	p.runAction(ev.State, stage.Action)
+}
+
+func (p *PolicyEngine) retryPending() {
+	for key := range p.pending {
+		stage, ok := p.config.Get().EffectiveTimeline().Stage(key.State, key.Index)
+		if !ok || p.SM.ReadState() != key.State {
+			delete(p.pending, key)
+			continue
+		}
+		if conditionsMet(stage.When, p.checkCondition) {
+			lg.Debug("stage conditions met, running pending stage", "state", key.State.String(), "stage", key.Index)
+			delete(p.pending, key)
+			p.runAction(key.State, stage.Action)
+		}
+	}
+}
+
+func (p *PolicyEngine) handlePower(status power.Status) {
+	p.powerStatus = status
+	profile := profileFor(status, p.baseConfig.BatteryLowPercent)
+	if profile != p.config.Get().profile {
+		lg.Info("Power source changed, switching profile", "profile", profile)
+		p.applyConfig()
+	}
+	p.batteryMonitor(status)
+	p.retryPending()
+}
+
+func (p *PolicyEngine) handleLockStatus(status LockStatus) {
+	if status == LockExit {
+		lg.Debug("LockExit event", "", status.String())
+		clear(p.pending)
+		p.activate("unlock")
+	}
+	p.outputsOn("unlock")
+}
+
+func (p *PolicyEngine) handleNetwork(ev NetworkEvent) {
+	if !p.Locker.Running() {
+		return
+	}
+	if ev.Trusted {
+		lg.Debug("on a trusted network, unlocking")
+		p.Locker.Stop("trusted_network")
+		return
+	}
+	lg.Debug("Not connected to trusted wifi")
+	p.outputsOn("unlock")
+}
+
+// handleSleepResumed picks up the idle state machine after a sleep, the
+// locker was started before sleeping, unless it was already unlocked
+func (p *PolicyEngine) handleSleepResumed() {
+	if p.Locker.Running() {
+		lg.Debug("resumed while locked, entering idle state")
+		p.SM.SetState(Idle, "resume", 0, nop)
+	}
+}
+
+func (p *PolicyEngine) handleLid(lidEvent LidEvent) {
+	if p.lidClosed() != (lidEvent == LidClose) {
+		return
+	}
+	if lidEvent == LidOpen {
+		lg.Debug("got LidOpen event")
+		p.hooks.Run("on_lid_open", "lid")
+		if p.SM.ReadState() == Active {
+			p.outputsOn("lid")
+		}
+	} else {
+		lg.Debug("got LidClose event")
+		p.hooks.Run("on_lid_close", "lid")
+		if p.Outputs.NumOutputs() == 1 {
+			go p.events.Post(Suspend)
+		} else {
+			p.outputsOff("lid")
+		}
+	}
+	p.retryPending()
+}
+
+func (p *PolicyEngine) handleUserRequest(req UserRequest) error {
+	lg.Debug("userRequests", "", req.String())
+	switch req {
+	case Lock:
+		started := false
+		p.SM.SetState(Idle, "lock", p.config.Get().LockInitIgnoreInputTimeout.Duration, func() bool {
+			p.outputsOff("lock")
+			started = p.Locker.StartUser()
+			return started
+		})
+		if !started {
+			return ErrLockerFailed
+		}
+	case Suspend:
+		return p.sleep(false, "sleep", p.sleeper.Suspend)
+	case Hibernate:
+		return p.sleep(false, "sleep", p.sleeper.Hibernate)
+	case HybridSleep:
+		return p.sleep(false, "sleep", p.sleeper.HybridSleep)
+	case Unlock:
+		p.Locker.Stop("manual")
+	case BatteryCritical:
+		switch {
+		case p.sleeper.BatteryCritical == nil:
+		case p.sleeper.BatteryCriticalResumes:
+			return p.sleep(false, "battery_critical", p.sleeper.BatteryCritical)
+		default:
+			return p.shutdown("battery_critical", p.sleeper.BatteryCritical)
+		}
+	case IdleInhibit, IdleAllow:
+		// the registry is the source of truth, these requests may arrive
+		// out of order
+		inhibited := p.inhibitors.Inhibited()
+		if (inhibited && p.SM.ReadState() == Active) || (!inhibited && p.SM.ReadState() == None) {
+			p.activate("inhibitor")
+		} else if p.lockDeferred && !p.inhibitors.LockInhibited() && p.SM.ReadState() == Active {
+			// still idle since the screen was turned off
+			p.lockIdle()
+		}
+	}
+	return nil
+}
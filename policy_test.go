@@ -0,0 +1,727 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/trbjo/goidle/power"
+)
+
+func TestMain(m *testing.M) {
+	// keep the locker from pausing the media players of the session running
+	// the tests
+	os.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path=/nonexistent")
+	os.Exit(m.Run())
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Duration
+}
+
+func (c *fakeClock) SinceBoot() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now += d
+}
+
+type fakeTimeout struct {
+	timeout          time.Duration
+	ignoreInhibitors bool
+	onIdle, onResume func()
+	elapsed          time.Duration
+	idled            bool
+}
+
+// fakeNotifier stands in for the compositor. Idle and Input fire the idle and
+// resume events of the registered timeouts like ext_idle_notify_v1 does.
+type fakeNotifier struct {
+	mu       sync.Mutex
+	clock    *fakeClock
+	timeouts map[*fakeTimeout]struct{}
+}
+
+func newFakeNotifier(clock *fakeClock) *fakeNotifier {
+	return &fakeNotifier{clock: clock, timeouts: make(map[*fakeTimeout]struct{})}
+}
+
+func (n *fakeNotifier) RegisterIdleTimeout(timeout time.Duration, ignoreInhibitors bool, onIdle, onResume func()) IdleTimeout {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	t := &fakeTimeout{timeout: timeout, ignoreInhibitors: ignoreInhibitors, onIdle: onIdle, onResume: onResume}
+	n.timeouts[t] = struct{}{}
+	return t
+}
+
+func (n *fakeNotifier) UnregisterIdleTimeout(timeout IdleTimeout) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.timeouts, timeout.(*fakeTimeout))
+}
+
+// Idle lets d pass without input and fires the timeouts that ran out, shortest
+// first.
+func (n *fakeNotifier) Idle(d time.Duration) {
+	n.clock.Sleep(d)
+	n.mu.Lock()
+	var fired []*fakeTimeout
+	for t := range n.timeouts {
+		t.elapsed += d
+		if !t.idled && t.elapsed >= t.timeout {
+			t.idled = true
+			fired = append(fired, t)
+		}
+	}
+	n.mu.Unlock()
+	sort.Slice(fired, func(i, j int) bool { return fired[i].timeout < fired[j].timeout })
+	for _, t := range fired {
+		t.onIdle()
+	}
+}
+
+// Input resets every timeout and fires the resume events of the idled ones.
+func (n *fakeNotifier) Input() {
+	n.mu.Lock()
+	var resumed []*fakeTimeout
+	for t := range n.timeouts {
+		t.elapsed = 0
+		if t.idled {
+			t.idled = false
+			resumed = append(resumed, t)
+		}
+	}
+	n.mu.Unlock()
+	sort.Slice(resumed, func(i, j int) bool { return resumed[i].timeout < resumed[j].timeout })
+	for _, t := range resumed {
+		t.onResume()
+	}
+}
+
+type fakeOutputs struct {
+	count int
+	off   bool
+}
+
+func (o *fakeOutputs) On()             { o.off = false }
+func (o *fakeOutputs) Off()            { o.off = true }
+func (o *fakeOutputs) NumOutputs() int { return o.count }
+func (o *fakeOutputs) ListOutputNames() []string {
+	return []string{"eDP-1", "DP-1"}[:o.count]
+}
+
+type harness struct {
+	t        *testing.T
+	engine   *PolicyEngine
+	clock    *fakeClock
+	notifier *fakeNotifier
+	outputs  *fakeOutputs
+	dimmed   bool
+	lid      bool
+	locked   atomic.Bool
+	suspends int
+	// sleepFails makes the sleeper fail
+	sleepFails bool
+	trusted    bool
+	signals    []string
+}
+
+func newHarness(t *testing.T, outputs int, onBattery bool) *harness {
+	h := &harness{
+		t:       t,
+		clock:   &fakeClock{},
+		outputs: &fakeOutputs{count: outputs},
+	}
+	h.notifier = newFakeNotifier(h.clock)
+
+	baseConfig := &Config{
+		LockCommand:       []string{"sleep", "60"},
+		IdleGraceDuration: Duration{Duration: 30 * time.Second},
+	}
+	baseConfig.applyDefaults()
+	powerStatus := power.Status{OnBattery: onBattery, Capacity: 80}
+	config := NewSafeState(baseConfig.WithProfile(profileFor(powerStatus, baseConfig.BatteryLowPercent)))
+	state := LoadRuntimeState(filepath.Join(t.TempDir(), "state.json"), baseConfig)
+
+	SM := NewStateManager(h.notifier, h.clock)
+	events := NewEventQueue()
+	inhibitors := NewInhibitorRegistry(func(inhibited bool) {
+		if inhibited {
+			go events.Post(IdleInhibit)
+		} else {
+			go events.Post(IdleAllow)
+		}
+	})
+	locker := CreateLockManager(config, state, h.clock, events.Post, func(locked bool, reason string) {
+		h.locked.Store(locked)
+	})
+	t.Cleanup(func() {
+		for i := 0; locker.Running() && i < 100; i++ {
+			locker.Stop("manual")
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	h.engine = &PolicyEngine{
+		Actuators: Actuators{
+			Outputs: h.outputs,
+			Backlight: func(b BackLight) {
+				h.dimmed = b == Dim
+			},
+			Keyboard: NewKeyboardBacklight(),
+			Locker:   locker,
+			NewSleeper: func(config *Config) Sleeper {
+				suspend := func() bool {
+					if h.sleepFails {
+						return false
+					}
+					h.suspends++
+					// time passes while suspended
+					h.clock.Sleep(time.Hour)
+					return true
+				}
+				return Sleeper{Suspend: suspend, Hibernate: suspend, HybridSleep: suspend}
+			},
+		},
+		SM:             SM,
+		clock:          h.clock,
+		config:         config,
+		baseConfig:     baseConfig,
+		powerStatus:    powerStatus,
+		events:         events,
+		inhibitors:     inhibitors,
+		hooks:          NewHookRunner(config, SM.ReadState, h.outputs.ListOutputNames),
+		lidClosed:      func() bool { return h.lid },
+		batteryMonitor: func(power.Status) {},
+		refreshMedia:   func() {},
+		changed:        func(names ...string) {},
+		emit:           func(signal string, args ...any) { h.signals = append(h.signals, signal) },
+		checkNetwork:   func(result func(bool)) { result(h.trusted) },
+	}
+	h.engine.Start()
+	return h
+}
+
+// drain handles the queued events.
+func (h *harness) drain() {
+	for {
+		select {
+		case ev := <-h.engine.events:
+			h.engine.Handle(ev)
+		default:
+			return
+		}
+	}
+}
+
+func (h *harness) idle(d time.Duration) {
+	h.notifier.Idle(d)
+	h.drain()
+}
+
+func (h *harness) input() {
+	h.notifier.Input()
+	h.drain()
+}
+
+// next handles the next event, for events that are posted asynchronously.
+func (h *harness) next() {
+	select {
+	case ev := <-h.engine.events:
+		h.engine.Handle(ev)
+		h.drain()
+	case <-time.After(2 * time.Second):
+		h.t.Fatal("no event")
+	}
+}
+
+// unlocked waits for the locker to exit and handles its events.
+func (h *harness) unlocked() {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-h.engine.events:
+			h.engine.Handle(ev)
+			if ev == LockExit {
+				return
+			}
+		case <-deadline:
+			h.t.Fatal("locker did not exit")
+		}
+	}
+}
+
+func (h *harness) lock() {
+	h.idle(h.engine.config.Get().TimeoutActiveToIdle.Duration)
+}
+
+func TestPolicyEngine(t *testing.T) {
+	tests := []struct {
+		name      string
+		outputs   int
+		onBattery bool
+		run       func(h *harness)
+
+		wantState    StateValue
+		wantLocked   bool
+		wantOff      bool
+		wantDimmed   bool
+		wantSuspends int
+	}{
+		{
+			name:       "dims before locking",
+			outputs:    1,
+			run:        func(h *harness) { h.idle(150 * time.Second) },
+			wantState:  Active,
+			wantDimmed: true,
+		},
+		{
+			name:    "input undims",
+			outputs: 1,
+			run: func(h *harness) {
+				h.idle(150 * time.Second)
+				h.input()
+			},
+			wantState: Active,
+		},
+		{
+			name:       "locks after the idle timeout",
+			outputs:    1,
+			run:        func(h *harness) { h.lock() },
+			wantState:  Idle,
+			wantLocked: true,
+			wantOff:    true,
+		},
+		{
+			name:    "input within the grace period unlocks",
+			outputs: 1,
+			run: func(h *harness) {
+				h.lock()
+				// the locker listens for stop requests in the background,
+				// input comes no earlier than the 30ms of the unlock probe
+				time.Sleep(30 * time.Millisecond)
+				h.idle(5 * time.Second)
+				h.input()
+				h.unlocked()
+			},
+			wantState: Active,
+		},
+		{
+			name:    "input after the grace period keeps the lock",
+			outputs: 1,
+			run: func(h *harness) {
+				h.lock()
+				h.idle(10 * time.Second)
+				h.clock.Sleep(time.Minute)
+				h.input()
+			},
+			wantState:  Idle,
+			wantLocked: true,
+		},
+		{
+			name:    "input on a trusted network unlocks",
+			outputs: 1,
+			run: func(h *harness) {
+				h.trusted = true
+				h.lock()
+				time.Sleep(30 * time.Millisecond)
+				h.idle(10 * time.Second)
+				h.clock.Sleep(time.Minute)
+				h.input()
+				h.unlocked()
+			},
+			wantState: Active,
+		},
+		{
+			name:    "user lock has no grace period",
+			outputs: 1,
+			run: func(h *harness) {
+				h.engine.Handle(Lock)
+				h.idle(time.Second)
+				h.input()
+			},
+			wantState:  Idle,
+			wantLocked: true,
+		},
+		{
+			name:      "suspends on battery with a single output",
+			outputs:   1,
+			onBattery: true,
+			run: func(h *harness) {
+				h.lock()
+				h.idle(20 * time.Second)
+			},
+			wantState:    Idle,
+			wantLocked:   true,
+			wantSuspends: 1,
+		},
+		{
+			name:    "stays awake on AC",
+			outputs: 1,
+			run: func(h *harness) {
+				h.lock()
+				h.idle(20 * time.Second)
+				h.idle(20 * time.Second)
+			},
+			wantState:  Idle,
+			wantLocked: true,
+			wantOff:    true,
+		},
+		{
+			name:    "pending suspend runs when unplugged",
+			outputs: 1,
+			run: func(h *harness) {
+				h.lock()
+				h.idle(20 * time.Second)
+				h.engine.Handle(PowerEvent{Status: power.Status{OnBattery: true, Capacity: 80}})
+			},
+			wantState:    Idle,
+			wantLocked:   true,
+			wantSuspends: 1,
+		},
+		{
+			name:      "pending suspend runs when the monitor is unplugged",
+			outputs:   2,
+			onBattery: true,
+			run: func(h *harness) {
+				h.lock()
+				h.idle(20 * time.Second)
+				h.outputs.count = 1
+				h.engine.Handle(OutputEvent{Name: "DP-1"})
+			},
+			wantState:    Idle,
+			wantLocked:   true,
+			wantSuspends: 1,
+		},
+		{
+			name:    "closing the lid suspends with a single output",
+			outputs: 1,
+			run: func(h *harness) {
+				h.lid = true
+				h.engine.Handle(LidClose)
+				h.next()
+			},
+			wantState:    Idle,
+			wantLocked:   true,
+			wantSuspends: 1,
+		},
+		{
+			name:    "closing the lid turns the outputs off with a monitor",
+			outputs: 2,
+			run: func(h *harness) {
+				h.lid = true
+				h.engine.Handle(LidClose)
+			},
+			wantState: Active,
+			wantOff:   true,
+		},
+		{
+			name:    "opening the lid turns the outputs on",
+			outputs: 2,
+			run: func(h *harness) {
+				h.lid = true
+				h.engine.Handle(LidClose)
+				h.lid = false
+				h.engine.Handle(LidOpen)
+			},
+			wantState: Active,
+		},
+		{
+			name:    "stale lid events are ignored",
+			outputs: 1,
+			run: func(h *harness) {
+				h.engine.Handle(LidClose)
+			},
+			wantState: Active,
+		},
+		{
+			name:    "inhibitor stops the timeouts",
+			outputs: 1,
+			run: func(h *harness) {
+				h.engine.inhibitors.Add(":1.1", "test", "testing", 0)
+				h.next()
+				h.lock()
+			},
+			wantState: None,
+		},
+		{
+			name:    "releasing the inhibitor reactivates",
+			outputs: 1,
+			run: func(h *harness) {
+				cookie := h.engine.inhibitors.Add(":1.1", "test", "testing", 0)
+				h.next()
+				h.engine.inhibitors.Remove(cookie)
+				h.next()
+				h.lock()
+			},
+			wantState:  Idle,
+			wantLocked: true,
+			wantOff:    true,
+		},
+		{
+			name:    "lock inhibitor only turns the outputs off",
+			outputs: 1,
+			run: func(h *harness) {
+				h.engine.inhibitors.AddLock(":1.1", "test", "testing")
+				h.next()
+				h.lock()
+			},
+			wantState: Active,
+			wantOff:   true,
+		},
+		{
+			name:    "releasing the lock inhibitor locks",
+			outputs: 1,
+			run: func(h *harness) {
+				cookie := h.engine.inhibitors.AddLock(":1.1", "test", "testing")
+				h.next()
+				h.lock()
+				h.engine.inhibitors.Remove(cookie)
+				h.next()
+			},
+			wantState:  Idle,
+			wantLocked: true,
+			wantOff:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, tt.outputs, tt.onBattery)
+			tt.run(h)
+			h.drain()
+
+			if got := h.engine.SM.ReadState(); got != tt.wantState {
+				t.Errorf("state = %s, want %s", got, tt.wantState)
+			}
+			if got := h.locked.Load(); got != tt.wantLocked {
+				t.Errorf("locked = %v, want %v", got, tt.wantLocked)
+			}
+			if h.outputs.off != tt.wantOff {
+				t.Errorf("outputs off = %v, want %v", h.outputs.off, tt.wantOff)
+			}
+			if h.dimmed != tt.wantDimmed {
+				t.Errorf("dimmed = %v, want %v", h.dimmed, tt.wantDimmed)
+			}
+			if h.suspends != tt.wantSuspends {
+				t.Errorf("suspends = %d, want %d", h.suspends, tt.wantSuspends)
+			}
+		})
+	}
+}
+
+func TestPolicyEngineSignals(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(h *harness)
+		want []string
+	}{
+		{
+			name: "dim and undim",
+			run: func(h *harness) {
+				h.idle(150 * time.Second)
+				h.input()
+			},
+			want: []string{"Dimmed", "Undimmed"},
+		},
+		{
+			name: "lock",
+			run:  func(h *harness) { h.lock() },
+			want: []string{"Dimmed", "OutputsOff"},
+		},
+		{
+			name: "input after the grace period",
+			run: func(h *harness) {
+				h.lock()
+				h.idle(10 * time.Second)
+				h.clock.Sleep(time.Minute)
+				h.input()
+			},
+			want: []string{"Dimmed", "OutputsOff", "UnlockFailed", "OutputsOn"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, 1, false)
+			tt.run(h)
+			h.drain()
+			if !slices.Equal(h.signals, tt.want) {
+				t.Errorf("signals %q, want %q", h.signals, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateManagerRearm(t *testing.T) {
+	clock := &fakeClock{}
+	notifier := newFakeNotifier(clock)
+	SM := NewStateManager(notifier, clock)
+
+	fired := 0
+	var h *TimeoutHandler
+	h = SM.RegisterTimeout(Active, time.Minute, false, func() { fired++ }, func() {})
+	SM.SetState(Active, "test", 0, nop)
+
+	notifier.Idle(time.Minute)
+	notifier.Idle(time.Minute)
+	if fired != 1 {
+		t.Fatalf("fired %d times without rearming, want 1", fired)
+	}
+	SM.Rearm(h)
+	notifier.Idle(time.Minute)
+	if fired != 2 {
+		t.Fatalf("fired %d times after rearming, want 2", fired)
+	}
+
+	SM.SetState(Idle, "test", 0, nop)
+	SM.Rearm(h)
+	notifier.Idle(time.Minute)
+	if fired != 2 {
+		t.Fatalf("handler of another state fired after rearming")
+	}
+}
+
+func TestStateManagerOnChange(t *testing.T) {
+	clock := &fakeClock{}
+	SM := NewStateManager(newFakeNotifier(clock), clock)
+	var changes []string
+	SM.OnChange(func(old, new StateValue, reason string) {
+		changes = append(changes, stateName(old)+"->"+stateName(new))
+	})
+
+	SM.SetState(Active, "test", 0, nop)
+	SM.SetState(Active, "test", 0, nop)
+	SM.SetState(Idle, "test", 0, func() bool { return false })
+	SM.SetState(Idle, "test", 0, nop)
+
+	want := []string{"none->active", "active->none", "none->idle"}
+	if !slices.Equal(changes, want) {
+		t.Fatalf("changes %q, want %q", changes, want)
+	}
+}
+
+func TestPolicyEngineRequests(t *testing.T) {
+	failLocker := func(h *harness) {
+		h.engine.config.Get().LockCommand = []string{"/nonexistent/locker"}
+	}
+	tests := []struct {
+		name  string
+		setup func(h *harness)
+		req   UserRequest
+		want  error
+	}{
+		{name: "lock", req: Lock},
+		{name: "locker fails", setup: failLocker, req: Lock, want: ErrLockerFailed},
+		{name: "suspend", req: Suspend},
+		{name: "sleep fails", setup: func(h *harness) { h.sleepFails = true }, req: Hibernate, want: ErrSuspendFailed},
+		{name: "suspend without locker", setup: failLocker, req: Suspend, want: ErrLockerFailed},
+		{name: "unlock", req: Unlock},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, 1, false)
+			if tt.setup != nil {
+				tt.setup(h)
+			}
+			result := make(chan error, 1)
+			h.engine.Handle(Request{UserRequest: tt.req, Result: result})
+			if err := <-result; !errors.Is(err, tt.want) {
+				t.Errorf("%s returned %v, want %v", tt.req, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyEngineNextStage(t *testing.T) {
+	h := newHarness(t, 1, false)
+	config := h.engine.config.Get()
+	expect := func(action string, in time.Duration) {
+		t.Helper()
+		next := h.engine.NextStage()
+		if next.Action != action {
+			t.Fatalf("next stage %q, want %q", next.Action, action)
+		}
+		if d := time.Until(next.At); d < in-2*time.Second || d > in {
+			t.Errorf("%s in %s, want %s", action, d, in)
+		}
+	}
+	expect(ActionDim, config.TimeoutActiveDim.Duration)
+	h.idle(config.TimeoutActiveDim.Duration)
+	expect(ActionLock, config.TimeoutActiveToIdle.Duration-config.TimeoutActiveDim.Duration)
+	h.input()
+	expect(ActionDim, config.TimeoutActiveDim.Duration)
+	h.lock()
+	expect(ActionOutputsOff, config.TimeoutIdleBacklightOff.Duration)
+}
+
+func TestSleepHooksBatteryCritical(t *testing.T) {
+	h := newHarness(t, 1, true)
+	hooksRan := false
+	s := h.engine.withSleepHooks(Sleeper{BatteryCritical: func() bool {
+		hooksRan = h.engine.sleepHooksRan.Load()
+		return true
+	}})
+	s.BatteryCritical()
+	if !hooksRan {
+		t.Error("before_sleep did not run ahead of the critical battery sleep")
+	}
+	if h.engine.withSleepHooks(Sleeper{}).BatteryCritical != nil {
+		t.Error("a missing battery_critical_action got a sleep function")
+	}
+}
+
+func TestPolicyEngineBatteryCritical(t *testing.T) {
+	tests := []struct {
+		name    string
+		resumes bool
+	}{
+		{name: "poweroff", resumes: false},
+		{name: "hibernate", resumes: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, 1, true)
+			ran := false
+			h.engine.sleeper = Sleeper{
+				BatteryCritical: func() bool {
+					ran = h.engine.Locker.Running()
+					// the locker listens for stop requests in the background
+					time.Sleep(30 * time.Millisecond)
+					return true
+				},
+				BatteryCriticalResumes: tt.resumes,
+			}
+			result := make(chan error, 1)
+			h.engine.Handle(Request{UserRequest: BatteryCritical, Result: result})
+			if err := <-result; err != nil {
+				t.Fatalf("BatteryCritical returned %v", err)
+			}
+			if !ran {
+				t.Fatal("the critical action ran without the locker")
+			}
+			if tt.resumes {
+				// resumed within the grace period
+				h.unlocked()
+				return
+			}
+			// logind returns from PowerOff while the system goes down
+			time.Sleep(50 * time.Millisecond)
+			h.drain()
+			if !h.engine.Locker.Running() || h.engine.SM.ReadState() != Idle {
+				t.Error("the locker was stopped after a critical poweroff")
+			}
+		})
+	}
+}
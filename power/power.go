@@ -0,0 +1,123 @@
+package power
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/trbjo/goidle/logger"
+)
+
+var lg = logger.Slog
+
+const SysfsRoot = "/sys"
+
+type Supply struct {
+	Name   string
+	Type   string
+	Scope  string
+	Online bool
+	// State is the battery status attribute, e.g. Charging or Discharging.
+	State string
+	// Capacity is the charge in percent, or -1 when not reported.
+	Capacity int
+}
+
+type Status struct {
+	OnBattery bool
+	// Capacity is the average charge of the system batteries in percent, or
+	// -1 without a battery.
+	Capacity int
+}
+
+// external reports whether the supply feeds the system from the outside.
+// Chargers are not necessarily called AC*, USB-C chargers show up as USB.
+func (s Supply) external() bool {
+	return s.Type == "Mains" || strings.HasPrefix(s.Type, "USB")
+}
+
+// systemBattery excludes the batteries of peripherals like mice and
+// headsets, which the kernel lists with a Device scope.
+func (s Supply) systemBattery() bool {
+	return s.Type == "Battery" && s.Scope != "Device"
+}
+
+func readAttr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// ReadSupplies lists the power supplies below root, which is /sys on a real
+// system.
+func ReadSupplies(root string) ([]Supply, error) {
+	base := filepath.Join(root, "class", "power_supply")
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return nil, err
+	}
+
+	supplies := make([]Supply, 0, len(entries))
+	for _, entry := range entries {
+		dir := filepath.Join(base, entry.Name())
+		supply := Supply{
+			Name:     entry.Name(),
+			Type:     readAttr(dir, "type"),
+			Scope:    readAttr(dir, "scope"),
+			Online:   readAttr(dir, "online") == "1",
+			State:    readAttr(dir, "status"),
+			Capacity: -1,
+		}
+		if capacity, err := strconv.Atoi(readAttr(dir, "capacity")); err == nil {
+			supply.Capacity = capacity
+		}
+		supplies = append(supplies, supply)
+	}
+	return supplies, nil
+}
+
+// StatusOf summarizes supplies. Without any external supply the system is
+// considered to run on battery only if a battery reports discharging, so
+// desktops never count as being on battery.
+func StatusOf(supplies []Supply) Status {
+	status := Status{Capacity: -1}
+	hasExternal, online, discharging := false, false, false
+	total, batteries := 0, 0
+
+	for _, supply := range supplies {
+		if supply.external() {
+			hasExternal = true
+			online = online || supply.Online
+		}
+		if supply.systemBattery() {
+			discharging = discharging || supply.State == "Discharging"
+			if supply.Capacity >= 0 {
+				total += supply.Capacity
+				batteries++
+			}
+		}
+	}
+
+	if batteries > 0 {
+		status.Capacity = total / batteries
+	}
+
+	if hasExternal {
+		status.OnBattery = !online && batteries > 0
+	} else {
+		status.OnBattery = discharging
+	}
+	return status
+}
+
+func ReadStatus(root string) Status {
+	supplies, err := ReadSupplies(root)
+	if err != nil {
+		lg.Debug("Could not read power supplies", "error", err.Error())
+		return Status{Capacity: -1}
+	}
+	return StatusOf(supplies)
+}
@@ -0,0 +1,106 @@
+package power
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSupply creates a power supply with the given attributes below root.
+func writeSupply(t *testing.T, root, name string, attrs map[string]string) {
+	t.Helper()
+	dir := filepath.Join(root, "class", "power_supply", name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for attr, value := range attrs {
+		if err := os.WriteFile(filepath.Join(dir, attr), []byte(value+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadStatus(t *testing.T) {
+	battery := func(status, capacity string) map[string]string {
+		return map[string]string{"type": "Battery", "scope": "System", "status": status, "capacity": capacity}
+	}
+	tests := []struct {
+		name     string
+		supplies map[string]map[string]string
+		want     Status
+	}{
+		{
+			name: "mains online",
+			supplies: map[string]map[string]string{
+				"AC":   {"type": "Mains", "online": "1"},
+				"BAT0": battery("Charging", "60"),
+			},
+			want: Status{OnBattery: false, Capacity: 60},
+		},
+		{
+			name: "mains offline",
+			supplies: map[string]map[string]string{
+				"AC":   {"type": "Mains", "online": "0"},
+				"BAT0": battery("Discharging", "60"),
+			},
+			want: Status{OnBattery: true, Capacity: 60},
+		},
+		{
+			name: "usb charger",
+			supplies: map[string]map[string]string{
+				"ucsi-source-psy-USBC000:001": {"type": "USB", "online": "1"},
+				"BAT0":                        battery("Charging", "40"),
+			},
+			want: Status{OnBattery: false, Capacity: 40},
+		},
+		{
+			name: "device batteries are ignored",
+			supplies: map[string]map[string]string{
+				"AC":              {"type": "Mains", "online": "0"},
+				"BAT0":            battery("Discharging", "70"),
+				"hidpp_battery_0": {"type": "Battery", "scope": "Device", "status": "Discharging", "capacity": "10"},
+			},
+			want: Status{OnBattery: true, Capacity: 70},
+		},
+		{
+			name: "several batteries",
+			supplies: map[string]map[string]string{
+				"AC":   {"type": "Mains", "online": "0"},
+				"BAT0": battery("Discharging", "80"),
+				"BAT1": battery("Discharging", "40"),
+			},
+			want: Status{OnBattery: true, Capacity: 60},
+		},
+		{
+			name: "desktop without battery",
+			supplies: map[string]map[string]string{
+				"AC": {"type": "Mains", "online": "0"},
+			},
+			want: Status{OnBattery: false, Capacity: -1},
+		},
+		{
+			name: "no external supply",
+			supplies: map[string]map[string]string{
+				"BAT0": battery("Discharging", "30"),
+			},
+			want: Status{OnBattery: true, Capacity: 30},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, attrs := range tt.supplies {
+				writeSupply(t, root, name, attrs)
+			}
+			if got := ReadStatus(root); got != tt.want {
+				t.Errorf("ReadStatus = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadStatusMissingRoot(t *testing.T) {
+	if got := ReadStatus(t.TempDir()); got != (Status{Capacity: -1}) {
+		t.Errorf("ReadStatus without power supplies = %+v", got)
+	}
+}
@@ -0,0 +1,122 @@
+package power
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+)
+
+var errUPowerMissing = errors.New("UPower is not running")
+
+const (
+	upowerName = "org.freedesktop.UPower"
+	upowerPath = "/org/freedesktop/UPower"
+)
+
+// Watch calls cb whenever the power status read from root changes. It is
+// woken up by UPower on the system bus and falls back to kernel uevents when
+// UPower isn't running. Watch only returns on error.
+func Watch(root string, cb func(Status)) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err == nil {
+		err = WatchBus(conn, root, cb)
+		conn.Close()
+	}
+	lg.Info("UPower not available, watching uevents instead", "reason", err.Error())
+	return WatchUevents(root, cb)
+}
+
+func notifier(root string, cb func(Status)) func() {
+	last := ReadStatus(root)
+	return func() {
+		current := ReadStatus(root)
+		if current == last {
+			return
+		}
+		lg.Debug("power status changed", "on_battery", current.OnBattery, "capacity", current.Capacity)
+		last = current
+		cb(current)
+	}
+}
+
+// WatchBus re-reads the power status on every PropertiesChanged signal
+// UPower sends on conn.
+func WatchBus(conn *dbus.Conn, root string, cb func(Status)) error {
+	var hasOwner bool
+	err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, upowerName).Store(&hasOwner)
+	if err != nil {
+		return err
+	}
+	if !hasOwner {
+		return errUPowerMissing
+	}
+
+	match := []dbus.MatchOption{
+		dbus.WithMatchSender(upowerName),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+		dbus.WithMatchPathNamespace(dbus.ObjectPath(upowerPath)),
+	}
+	if err := conn.AddMatchSignal(match...); err != nil {
+		return err
+	}
+	defer conn.RemoveMatchSignal(match...)
+
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+	defer conn.RemoveSignal(signals)
+
+	notify := notifier(root, cb)
+	lg.Debug("Watching UPower for power changes")
+	for signal := range signals {
+		if signal.Name == "org.freedesktop.DBus.Properties.PropertiesChanged" &&
+			strings.HasPrefix(string(signal.Path), upowerPath) {
+			notify()
+		}
+	}
+	return dbus.ErrClosed
+}
+
+// WatchUevents re-reads the power status whenever the kernel announces a
+// power_supply change on the uevent netlink socket.
+func WatchUevents(root string, cb func(Status)) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		return err
+	}
+
+	notify := notifier(root, cb)
+	buf := make([]byte, 8192)
+	lg.Debug("Watching uevents for power changes")
+	for {
+		n, err := unix.Read(fd, buf)
+		if err != nil {
+			if err == unix.EINTR || err == unix.ENOBUFS {
+				continue
+			}
+			return err
+		}
+		if IsPowerSupplyUevent(buf[:n]) {
+			notify()
+		}
+	}
+}
+
+// IsPowerSupplyUevent reports whether msg, a NUL separated kernel uevent,
+// concerns the power_supply subsystem.
+func IsPowerSupplyUevent(msg []byte) bool {
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		if string(field) == "SUBSYSTEM=power_supply" {
+			return true
+		}
+	}
+	return false
+}
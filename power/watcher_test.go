@@ -0,0 +1,185 @@
+package power
+
+import (
+	"bufio"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestIsPowerSupplyUevent(t *testing.T) {
+	uevent := func(fields ...string) []byte {
+		return []byte(strings.Join(fields, "\x00") + "\x00")
+	}
+	tests := []struct {
+		name string
+		msg  []byte
+		want bool
+	}{
+		{
+			name: "charger plugged in",
+			msg: uevent("change@/devices/LNXSYSTM:00/LNXSYBUS:00/ACPI0003:00/power_supply/AC",
+				"ACTION=change", "DEVPATH=/devices/LNXSYSTM:00/LNXSYBUS:00/ACPI0003:00/power_supply/AC",
+				"SUBSYSTEM=power_supply", "POWER_SUPPLY_NAME=AC", "POWER_SUPPLY_TYPE=Mains",
+				"POWER_SUPPLY_ONLINE=1", "SEQNUM=4242"),
+			want: true,
+		},
+		{
+			name: "battery",
+			msg: uevent("change@/devices/LNXSYSTM:00/LNXSYBUS:00/PNP0C0A:00/power_supply/BAT0",
+				"ACTION=change", "SUBSYSTEM=power_supply", "POWER_SUPPLY_NAME=BAT0",
+				"POWER_SUPPLY_STATUS=Discharging", "POWER_SUPPLY_CAPACITY=57", "SEQNUM=4243"),
+			want: true,
+		},
+		{
+			name: "usb device",
+			msg: uevent("add@/devices/pci0000:00/0000:00:14.0/usb1/1-2", "ACTION=add",
+				"DEVPATH=/devices/pci0000:00/0000:00:14.0/usb1/1-2", "SUBSYSTEM=usb",
+				"DEVTYPE=usb_device", "PRODUCT=46d/c52b/1211", "SEQNUM=4244"),
+			want: false,
+		},
+		{
+			name: "name mentions power_supply",
+			msg:  uevent("change@/devices/platform/power_supply_monitor", "ACTION=change", "SUBSYSTEM=platform"),
+			want: false,
+		},
+		{name: "empty", msg: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPowerSupplyUevent(tt.msg); got != tt.want {
+				t.Errorf("IsPowerSupplyUevent = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// privateBus starts a dbus-daemon for the test and returns its address.
+func privateBus(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(address)
+}
+
+func connect(t *testing.T, address string) *dbus.Conn {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWatchBusWithoutUPower(t *testing.T) {
+	conn := connect(t, privateBus(t))
+	if err := WatchBus(conn, t.TempDir(), func(Status) {}); !errors.Is(err, errUPowerMissing) {
+		t.Errorf("WatchBus returned %v, want errUPowerMissing", err)
+	}
+}
+
+func TestWatchBus(t *testing.T) {
+	address := privateBus(t)
+	upower := connect(t, address)
+	if reply, err := upower.RequestName(upowerName, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("could not own %s: %v", upowerName, err)
+	}
+
+	root := t.TempDir()
+	writeSupply(t, root, "AC", map[string]string{"type": "Mains", "online": "1"})
+	writeSupply(t, root, "BAT0", map[string]string{"type": "Battery", "status": "Charging", "capacity": "50"})
+
+	conn := connect(t, address)
+	statuses := make(chan Status, 10)
+	done := make(chan error, 1)
+	go func() { done <- WatchBus(conn, root, func(s Status) { statuses <- s }) }()
+
+	// UPower announces a change of the line power device
+	plug := func(online bool) {
+		t.Helper()
+		value, status := "0", "Discharging"
+		if online {
+			value, status = "1", "Charging"
+		}
+		writeSupply(t, root, "AC", map[string]string{"online": value})
+		writeSupply(t, root, "BAT0", map[string]string{"status": status})
+		err := upower.Emit(upowerPath+"/devices/line_power_AC", "org.freedesktop.DBus.Properties.PropertiesChanged",
+			"org.freedesktop.UPower.Device", map[string]dbus.Variant{"Online": dbus.MakeVariant(online)}, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func(timeout time.Duration) (Status, bool) {
+		select {
+		case s := <-statuses:
+			return s, true
+		case err := <-done:
+			t.Fatalf("WatchBus returned %v", err)
+		case <-time.After(timeout):
+		}
+		return Status{}, false
+	}
+
+	// WatchBus reads the initial status once its match is added, so keep
+	// plugging and unplugging until it reports a change
+	online := true
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		online = !online
+		plug(online)
+		if s, ok := next(50 * time.Millisecond); ok {
+			if s.OnBattery == online {
+				t.Fatalf("status %+v after plugging %v", s, online)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no status change")
+		}
+	}
+
+	plug(!online)
+	want := Status{OnBattery: online, Capacity: 50}
+	if s, ok := next(5 * time.Second); !ok || s != want {
+		t.Fatalf("status %+v, want %+v", s, want)
+	}
+
+	// signals that do not change the status are not reported
+	upower.Emit(upowerPath, "org.freedesktop.DBus.Properties.PropertiesChanged",
+		"org.freedesktop.UPower", map[string]dbus.Variant{"OnBattery": dbus.MakeVariant(true)}, []string{})
+	if s, ok := next(100 * time.Millisecond); ok {
+		t.Errorf("unexpected status %+v", s)
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, dbus.ErrClosed) {
+			t.Errorf("WatchBus returned %v, want dbus.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("WatchBus did not return after the connection closed")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import "github.com/trbjo/goidle/power"
+
+// Profile overrides a subset of the timeout and backlight settings while
+// goidle runs on a given power source. Unset fields keep the top-level value.
+type Profile struct {
+	BacklightCurveFactor    *float64  `json:"backlight_curve_factor"`
+	BacklightDimRatio       *float64  `json:"backlight_dim_ratio"`
+	BacklightSteps          *int      `json:"backlight_steps"`
+	TimeoutActiveDim        *Duration `json:"timeout_active_dim"`
+	TimeoutActiveToIdle     *Duration `json:"timeout_active_to_idle"`
+	TimeoutIdleBacklightOff *Duration `json:"timeout_idle_backlight_off"`
+	TimeoutIdleToSuspend    *Duration `json:"timeout_idle_to_suspend"`
+	Timeline                *Timeline `json:"timeline"`
+}
+
+const (
+	ProfileAC         = "ac"
+	ProfileBattery    = "battery"
+	ProfileBatteryLow = "battery_low"
+)
+
+var profileNames = []string{ProfileAC, ProfileBattery, ProfileBatteryLow}
+
+// profileFor returns the name of the profile to use for a power status.
+func profileFor(status power.Status, lowPercent int) string {
+	if !status.OnBattery {
+		return ProfileAC
+	}
+	if status.Capacity >= 0 && status.Capacity <= lowPercent {
+		return ProfileBatteryLow
+	}
+	return ProfileBattery
+}
+
+// profileChain lists the profiles applied, in order, for a power source.
+// battery_low builds on top of battery so it only has to name what differs.
+func profileChain(name string) []string {
+	switch name {
+	case ProfileBattery:
+		return []string{ProfileBattery}
+	case ProfileBatteryLow:
+		return []string{ProfileBattery, ProfileBatteryLow}
+	case ProfileAC:
+		return []string{ProfileAC}
+	default:
+		return nil
+	}
+}
+
+// WithProfile returns a copy of c with the overrides of the named profile
+// applied. Profiles missing from the config leave the copy unchanged.
+func (c *Config) WithProfile(name string) *Config {
+	merged := *c
+	for _, step := range profileChain(name) {
+		p, ok := c.Profiles[step]
+		if !ok {
+			continue
+		}
+		if p.BacklightCurveFactor != nil {
+			merged.BacklightCurveFactor = *p.BacklightCurveFactor
+		}
+		if p.BacklightDimRatio != nil {
+			merged.BacklightDimRatio = *p.BacklightDimRatio
+		}
+		if p.BacklightSteps != nil {
+			merged.BacklightSteps = *p.BacklightSteps
+		}
+		if p.TimeoutActiveDim != nil {
+			merged.TimeoutActiveDim = *p.TimeoutActiveDim
+		}
+		if p.TimeoutActiveToIdle != nil {
+			merged.TimeoutActiveToIdle = *p.TimeoutActiveToIdle
+		}
+		if p.TimeoutIdleBacklightOff != nil {
+			merged.TimeoutIdleBacklightOff = *p.TimeoutIdleBacklightOff
+		}
+		if p.TimeoutIdleToSuspend != nil {
+			merged.TimeoutIdleToSuspend = *p.TimeoutIdleToSuspend
+		}
+		if p.Timeline != nil {
+			merged.Timeline = p.Timeline
+		}
+	}
+	merged.profile = name
+	return &merged
+}
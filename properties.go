@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const propertiesInterface = "org.freedesktop.DBus.Properties"
+
+// Properties implements org.freedesktop.DBus.Properties for an object whose
+// read-only properties are computed each time they are read.
+type Properties struct {
+	conn    *dbus.Conn
+	path    dbus.ObjectPath
+	mu      sync.Mutex
+	getters map[string]map[string]func() any
+	// emitMu orders Changed calls, emitted holds the values they last sent
+	emitMu  sync.Mutex
+	emitted map[string]map[string]any
+}
+
+func NewProperties(path dbus.ObjectPath) *Properties {
+	return &Properties{
+		path:    path,
+		getters: make(map[string]map[string]func() any),
+		emitted: make(map[string]map[string]any),
+	}
+}
+
+func (p *Properties) Register(iface, name string, get func() any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.getters[iface] == nil {
+		p.getters[iface] = make(map[string]func() any)
+	}
+	p.getters[iface][name] = get
+}
+
+// Export makes the properties available on conn. Changes are not signalled
+// before.
+func (p *Properties) Export(conn *dbus.Conn) error {
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+	return conn.Export(p, p.path, propertiesInterface)
+}
+
+// Introspect describes the properties of an interface for introspection.
+func (p *Properties) Introspect(iface string) []introspect.Property {
+	p.mu.Lock()
+	getters := make(map[string]func() any, len(p.getters[iface]))
+	for name, get := range p.getters[iface] {
+		getters[name] = get
+	}
+	p.mu.Unlock()
+
+	props := make([]introspect.Property, 0, len(getters))
+	for name, get := range getters {
+		props = append(props, introspect.Property{
+			Name:   name,
+			Type:   dbus.SignatureOf(get()).String(),
+			Access: "read",
+		})
+	}
+	slices.SortFunc(props, func(a, b introspect.Property) int { return strings.Compare(a.Name, b.Name) })
+	return props
+}
+
+func (p *Properties) getter(iface, name string) (func() any, *dbus.Error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	props, ok := p.getters[iface]
+	if !ok {
+		return nil, prop.ErrIfaceNotFound
+	}
+	get, ok := props[name]
+	if !ok {
+		return nil, prop.ErrPropNotFound
+	}
+	return get, nil
+}
+
+func (p *Properties) Get(iface, name string) (dbus.Variant, *dbus.Error) {
+	get, err := p.getter(iface, name)
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+	return dbus.MakeVariant(get()), nil
+}
+
+func (p *Properties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	p.mu.Lock()
+	props, ok := p.getters[iface]
+	getters := make(map[string]func() any, len(props))
+	for name, get := range props {
+		getters[name] = get
+	}
+	p.mu.Unlock()
+	if !ok {
+		return nil, prop.ErrIfaceNotFound
+	}
+
+	values := make(map[string]dbus.Variant, len(getters))
+	for name, get := range getters {
+		values[name] = dbus.MakeVariant(get())
+	}
+	return values, nil
+}
+
+func (p *Properties) Set(iface, name string, value dbus.Variant) *dbus.Error {
+	if _, err := p.getter(iface, name); err != nil {
+		return err
+	}
+	return prop.ErrReadOnly
+}
+
+// Changed emits PropertiesChanged with the current values of those of names
+// that differ from the values last emitted, so it can be called whenever they
+// might have changed.
+func (p *Properties) Changed(iface string, names ...string) {
+	p.emitMu.Lock()
+	defer p.emitMu.Unlock()
+
+	values := make(map[string]any, len(names))
+	for _, name := range names {
+		get, err := p.getter(iface, name)
+		if err != nil {
+			lg.Error("Unknown property changed", "interface", iface, "property", name)
+			continue
+		}
+		values[name] = get()
+	}
+
+	p.mu.Lock()
+	conn := p.conn
+	if p.emitted[iface] == nil {
+		p.emitted[iface] = make(map[string]any)
+	}
+	changed := make(map[string]dbus.Variant, len(values))
+	for name, value := range values {
+		if last, ok := p.emitted[iface][name]; ok && reflect.DeepEqual(last, value) {
+			continue
+		}
+		p.emitted[iface][name] = value
+		changed[name] = dbus.MakeVariant(value)
+	}
+	p.mu.Unlock()
+	if conn == nil || len(changed) == 0 {
+		return
+	}
+
+	err := conn.Emit(p.path, propertiesInterface+".PropertiesChanged", iface, changed, []string{})
+	if err != nil {
+		lg.Error("Failed to emit PropertiesChanged", "error", err.Error())
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// privateBus starts a dbus-daemon for the test and returns a connection to it
+// for the server and one for the client.
+func privateBus(t *testing.T) (*dbus.Conn, *dbus.Conn) {
+	t.Helper()
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []*dbus.Conn
+	for range 2 {
+		conn, err := dbus.Connect(strings.TrimSpace(address))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns = append(conns, conn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestProperties(t *testing.T) {
+	const iface = "io.github.trbjo.GoIdle.Test"
+	const path = dbus.ObjectPath("/io/github/trbjo/GoIdle/Test")
+	server, client := privateBus(t)
+
+	count := uint32(1)
+	outputs := []string{"eDP-1"}
+	props := NewProperties(path)
+	props.Register(iface, "Count", func() any { return count })
+	props.Register(iface, "Outputs", func() any { return slices.Clone(outputs) })
+	props.Register(iface, "Locked", func() any { return false })
+	if err := props.Export(server); err != nil {
+		t.Fatal(err)
+	}
+
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface(propertiesInterface),
+		dbus.WithMatchMember("PropertiesChanged"),
+	}
+	if err := client.AddMatchSignal(match...); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan *dbus.Signal, 10)
+	client.Signal(signals)
+	obj := client.Object(server.Names()[0], path)
+
+	t.Run("read", func(t *testing.T) {
+		var got uint32
+		if err := obj.Call(propertiesInterface+".Get", 0, iface, "Count").Store(&got); err != nil || got != 1 {
+			t.Errorf("Get Count = %d, %v", got, err)
+		}
+		var all map[string]dbus.Variant
+		if err := obj.Call(propertiesInterface+".GetAll", 0, iface).Store(&all); err != nil || len(all) != 3 {
+			t.Errorf("GetAll = %v, %v", all, err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			method string
+			args   []any
+			want   *dbus.Error
+		}{
+			{"Get", []any{"org.example.Missing", "Count"}, prop.ErrIfaceNotFound},
+			{"Get", []any{iface, "Missing"}, prop.ErrPropNotFound},
+			{"GetAll", []any{"org.example.Missing"}, prop.ErrIfaceNotFound},
+			{"Set", []any{iface, "Count", dbus.MakeVariant(uint32(2))}, prop.ErrReadOnly},
+			{"Set", []any{iface, "Missing", dbus.MakeVariant(uint32(2))}, prop.ErrPropNotFound},
+		}
+		for _, tt := range tests {
+			err := obj.Call(propertiesInterface+"."+tt.method, 0, tt.args...).Err
+			var dbusErr dbus.Error
+			if !errors.As(err, &dbusErr) || dbusErr.Name != tt.want.Name {
+				t.Errorf("%s%v returned %v, want %s", tt.method, tt.args, err, tt.want.Name)
+			}
+		}
+	})
+
+	t.Run("introspect", func(t *testing.T) {
+		want := []introspect.Property{
+			{Name: "Count", Type: "u", Access: "read"},
+			{Name: "Locked", Type: "b", Access: "read"},
+			{Name: "Outputs", Type: "as", Access: "read"},
+		}
+		if got := props.Introspect(iface); !reflect.DeepEqual(got, want) {
+			t.Errorf("Introspect = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		next := func() map[string]dbus.Variant {
+			t.Helper()
+			select {
+			case sig := <-signals:
+				if iface, _ := sig.Body[0].(string); iface != "io.github.trbjo.GoIdle.Test" {
+					t.Fatalf("PropertiesChanged for %s", iface)
+				}
+				changed, _ := sig.Body[1].(map[string]dbus.Variant)
+				return changed
+			case <-time.After(2 * time.Second):
+				t.Fatal("no PropertiesChanged")
+			}
+			return nil
+		}
+		names := func(changed map[string]dbus.Variant) []string {
+			var list []string
+			for name := range changed {
+				list = append(list, name)
+			}
+			return list
+		}
+
+		// values never emitted count as changed
+		props.Changed(iface, "Count", "Outputs")
+		if got := next(); len(got) != 2 {
+			t.Fatalf("first PropertiesChanged has %q, want Count and Outputs", names(got))
+		}
+
+		// unchanged values, including equal slices, are not sent
+		outputs = []string{"eDP-1"}
+		props.Changed(iface, "Count", "Outputs")
+		count = 2
+		props.Changed(iface, "Count", "Outputs")
+		got := next()
+		if len(got) != 1 || got["Count"].Value() != uint32(2) {
+			t.Fatalf("PropertiesChanged has %v, want only Count 2", got)
+		}
+
+		outputs = append(outputs, "DP-1")
+		props.Changed(iface, "Count", "Outputs")
+		got = next()
+		if v, _ := got["Outputs"].Value().([]string); len(got) != 1 || !reflect.DeepEqual(v, outputs) {
+			t.Fatalf("PropertiesChanged has %v, want only Outputs %q", got, outputs)
+		}
+		select {
+		case sig := <-signals:
+			t.Errorf("unexpected PropertiesChanged %v", sig.Body)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
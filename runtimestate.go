@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/trbjo/goidle/utilities"
+)
+
+// RuntimeState holds the settings changed at runtime through D-Bus. It lives
+// in its own file so the user's config is never written to.
+type RuntimeState struct {
+	TrustedWifis      []string   `json:"trusted_wifi_networks"`
+	IdleGraceDuration *Duration  `json:"idle_grace_duration,omitempty"`
+	CaffeineUntil     *time.Time `json:"caffeine_until,omitempty"`
+
+	path string
+	mu   sync.Mutex
+}
+
+func runtimeStatePath() string {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		stateHome = filepath.Join(os.Getenv("HOME"), ".local", "state")
+	}
+	return filepath.Join(stateHome, "goidle", "state.json")
+}
+
+// LoadRuntimeState reads the state file at path. When there is none yet, the
+// trusted networks from a config written by older versions are migrated.
+func LoadRuntimeState(path string, config *Config) *RuntimeState {
+	state := &RuntimeState{path: path, TrustedWifis: []string{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if len(config.TrustedWifis) > 0 {
+			state.TrustedWifis = append(state.TrustedWifis, config.TrustedWifis...)
+			if err := state.Save(); err != nil {
+				lg.Error("Failed to migrate trusted_wifi_networks", "error", err.Error())
+			} else {
+				lg.Info("Migrated trusted_wifi_networks to the state file, the key can be removed from the config",
+					"path", path)
+			}
+		}
+		return state
+	}
+	if err != nil {
+		lg.Error("Failed to read state file", "path", path, "error", err.Error())
+		return state
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		// keep the broken file, the next save replaces it
+		lg.Error("Failed to parse state file, starting with an empty state", "path", path, "error", err.Error(),
+			"backup", path+".bad")
+		if err := os.Rename(path, path+".bad"); err != nil {
+			lg.Error("Failed to back up the state file", "error", err.Error())
+		}
+		return &RuntimeState{path: path, TrustedWifis: []string{}}
+	}
+
+	for _, mac := range config.TrustedWifis {
+		if !slices.Contains(state.TrustedWifis, mac) {
+			lg.Warn("trusted_wifi_networks in the config is ignored once migrated, use WifiTrust instead", "mac", mac)
+			break
+		}
+	}
+	return state
+}
+
+// Save writes the state atomically, creating its directory if needed.
+func (s *RuntimeState) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+func (s *RuntimeState) save() error {
+	data, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	if err := utilities.WriteFileAtomic(s.path, data, 0600); err != nil {
+		return err
+	}
+	lg.Debug("wrote state", "path", s.path)
+	return nil
+}
+
+func (s *RuntimeState) Trusted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.TrustedWifis)
+}
+
+// AddCurrentWifi trusts the current WiFi network and returns its MAC address.
+func (s *RuntimeState) AddCurrentWifi() (string, error) {
+	mac, err := ExtractMac()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Contains(s.TrustedWifis, mac) {
+		return mac, nil
+	}
+	s.TrustedWifis = append(s.TrustedWifis, mac)
+	if err := s.save(); err != nil {
+		return "", fmt.Errorf("failed to save state: %w", err)
+	}
+	lg.Debug("successfully added wifi")
+	return mac, nil
+}
+
+// RemoveCurrentWifi distrusts the current WiFi network and returns its MAC
+// address.
+func (s *RuntimeState) RemoveCurrentWifi() (string, error) {
+	mac, err := ExtractMac()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.TrustedWifis = slices.DeleteFunc(s.TrustedWifis, func(macAddress string) bool {
+		return macAddress == mac
+	})
+	if err := s.save(); err != nil {
+		return "", fmt.Errorf("failed to save state: %w", err)
+	}
+	return mac, nil
+}
+
+// OnTrustedWifi reports whether the current WiFi network is trusted.
+func (s *RuntimeState) OnTrustedWifi() bool {
+	mac, err := ExtractMac()
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(s.TrustedWifis, mac)
+}
+
+// GraceDuration returns the grace duration set over D-Bus, or fallback from
+// the config when it was never changed at runtime.
+func (s *RuntimeState) GraceDuration(fallback time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.IdleGraceDuration == nil {
+		return fallback
+	}
+	return s.IdleGraceDuration.Duration
+}
+
+func (s *RuntimeState) SetGraceDuration(duration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.IdleGraceDuration = &Duration{Duration: duration}
+	return s.save()
+}
+
+// CaffeineDeadline returns the saved caffeine deadline, or the zero time when
+// there is none.
+func (s *RuntimeState) CaffeineDeadline() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.CaffeineUntil == nil {
+		return time.Time{}
+	}
+	return *s.CaffeineUntil
+}
+
+func (s *RuntimeState) SetCaffeineDeadline(deadline time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if deadline.IsZero() {
+		if s.CaffeineUntil == nil {
+			return nil
+		}
+		s.CaffeineUntil = nil
+	} else {
+		s.CaffeineUntil = &deadline
+	}
+	return s.save()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadRuntimeStateMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goidle", "state.json")
+	config := &Config{TrustedWifis: []string{"aa:bb:cc:dd:ee:ff"}}
+
+	state := LoadRuntimeState(path, config)
+	if got := state.Trusted(); !slices.Equal(got, config.TrustedWifis) {
+		t.Fatalf("trusted %q after migrating, want %q", got, config.TrustedWifis)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("the migrated state was not saved: %v", err)
+	}
+
+	// once migrated, the state file wins over the config
+	if err := LoadRuntimeState(path, config).SetGraceDuration(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	config.TrustedWifis = append(config.TrustedWifis, "11:22:33:44:55:66")
+	state = LoadRuntimeState(path, config)
+	if got := state.Trusted(); !slices.Equal(got, []string{"aa:bb:cc:dd:ee:ff"}) {
+		t.Errorf("trusted %q after reloading, want only the migrated network", got)
+	}
+	if got := state.GraceDuration(0); got != time.Minute {
+		t.Errorf("grace duration %s after reloading, want 1m", got)
+	}
+}
+
+func TestLoadRuntimeStateCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "truncated", data: `{"trusted_wifi_networks": ["aa:bb`},
+		{name: "wrong type", data: `{"trusted_wifi_networks": "aa:bb:cc:dd:ee:ff"}`},
+		{name: "empty", data: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			state := LoadRuntimeState(path, &Config{TrustedWifis: []string{"aa:bb:cc:dd:ee:ff"}})
+			if got := state.Trusted(); len(got) != 0 || state.GraceDuration(time.Second) != time.Second {
+				t.Errorf("state %+v from a corrupt file, want it empty", state)
+			}
+			if err := state.SetGraceDuration(time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := os.ReadFile(path + ".bad"); err != nil || string(data) != tt.data {
+				t.Errorf("backup %q, %v, want the corrupt file", data, err)
+			}
+			if got := LoadRuntimeState(path, &Config{}).GraceDuration(0); got != time.Minute {
+				t.Errorf("grace duration %s after saving over the corrupt file, want 1m", got)
+			}
+		})
+	}
+}
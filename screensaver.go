@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	screenSaverInterface = "org.freedesktop.ScreenSaver"
+	screenSaverPath      = "/org/freedesktop/ScreenSaver"
+	screenSaverAltPath   = "/ScreenSaver"
+)
+
+// ScreenSaver implements the org.freedesktop.ScreenSaver interface used by
+// browsers and media players to keep the screen from locking.
+type ScreenSaver struct {
+	conn        *dbus.Conn
+	inhibitors  *InhibitorRegistry
+	post        func(Event)
+	lockedSince *SafeState[time.Time]
+}
+
+func (s *ScreenSaver) Inhibit(sender dbus.Sender, app string, reason string) (uint32, *dbus.Error) {
+	return s.inhibitors.Add(string(sender), app, reason, 0), nil
+}
+
+func (s *ScreenSaver) UnInhibit(sender dbus.Sender, cookie uint32) *dbus.Error {
+	inhibitor, ok := s.inhibitors.Get(cookie)
+	if !ok || inhibitor.Owner != string(sender) {
+		lg.Debug("UnInhibit for unknown cookie", "cookie", cookie, "sender", sender)
+		return nil
+	}
+	s.inhibitors.Remove(cookie)
+	return nil
+}
+
+func (s *ScreenSaver) GetActive() (bool, *dbus.Error) {
+	return !s.lockedSince.Get().IsZero(), nil
+}
+
+// GetActiveTime returns the number of seconds the screen has been locked.
+func (s *ScreenSaver) GetActiveTime() (uint32, *dbus.Error) {
+	since := s.lockedSince.Get()
+	if since.IsZero() {
+		return 0, nil
+	}
+	return uint32(time.Since(since).Seconds()), nil
+}
+
+func (s *ScreenSaver) SetActive(active bool) (bool, *dbus.Error) {
+	if !active {
+		return false, nil
+	}
+	go func() { s.post(Lock) }()
+	return true, nil
+}
+
+func (s *ScreenSaver) Lock() *dbus.Error {
+	go func() { s.post(Lock) }()
+	return nil
+}
+
+func (s *ScreenSaver) SimulateUserActivity() *dbus.Error {
+	return nil
+}
+
+// SetLocked records the locker starting or exiting and emits ActiveChanged.
+func (s *ScreenSaver) SetLocked(locked bool) {
+	if locked {
+		s.lockedSince.Set(time.Now())
+	} else {
+		s.lockedSince.Set(time.Time{})
+	}
+	if s.conn == nil {
+		return
+	}
+	for _, path := range []dbus.ObjectPath{screenSaverPath, screenSaverAltPath} {
+		if err := s.conn.Emit(path, screenSaverInterface+".ActiveChanged", locked); err != nil {
+			lg.Error("Failed to emit ActiveChanged", "error", err.Error())
+		}
+	}
+}
+
+func setupScreenSaver(inhibitors *InhibitorRegistry, post func(Event)) *ScreenSaver {
+	s := &ScreenSaver{
+		inhibitors:  inhibitors,
+		post:        post,
+		lockedSince: NewSafeState(time.Time{}),
+	}
+
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		lg.Error("Failed to connect to session bus", "error", err)
+		return s
+	}
+
+	reply, err := conn.RequestName(screenSaverInterface, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		lg.Error("Failed to request name", "name", screenSaverInterface, "error", err)
+		return s
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		lg.Warn("Name already taken, not providing the ScreenSaver interface", "name", screenSaverInterface)
+		return s
+	}
+
+	s.conn = conn
+	conn.Export(s, screenSaverPath, screenSaverInterface)
+	conn.Export(s, screenSaverAltPath, screenSaverInterface)
+
+	lg.Debug("Listening on D-Bus", "interface", screenSaverInterface)
+	return s
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	login1Name          = "org.freedesktop.login1"
+	login1Path          = "/org/freedesktop/login1"
+	login1SessionIface  = "org.freedesktop.login1.Session"
+	login1ManagerIface  = "org.freedesktop.login1.Manager"
+	login1AutoSession   = "/org/freedesktop/login1/session/auto"
+	login1SessionIdProp = login1SessionIface + ".Id"
+)
+
+// resolveSession finds the object path of goidle's login session. goidle is
+// often started from a user service outside of any session, in which case
+// logind's "auto" session, the user's display session, is used.
+func resolveSession(conn *dbus.Conn) (dbus.ObjectPath, error) {
+	manager := conn.Object(login1Name, login1Path)
+	var path dbus.ObjectPath
+
+	if id := os.Getenv("XDG_SESSION_ID"); id != "" {
+		if err := manager.Call(login1ManagerIface+".GetSession", 0, id).Store(&path); err == nil {
+			return path, nil
+		}
+	}
+
+	if err := manager.Call(login1ManagerIface+".GetSessionByPID", 0, uint32(os.Getpid())).Store(&path); err == nil {
+		return path, nil
+	}
+
+	// signals are sent from the real path, never from the auto alias
+	variant, err := conn.Object(login1Name, login1AutoSession).GetProperty(login1SessionIdProp)
+	if err != nil {
+		return "", fmt.Errorf("no login session found: %w", err)
+	}
+	id, ok := variant.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected session id %v", variant.Value())
+	}
+	if err := manager.Call(login1ManagerIface+".GetSession", 0, id).Store(&path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// CreateSessionWatcher subscribes to the Lock and Unlock signals logind sends
+// for goidle's session, e.g. on loginctl lock-session, and returns a function
+// that sets the session's LockedHint.
+func CreateSessionWatcher(onLock func(), onUnlock func()) func(locked bool) {
+	nop := func(bool) {}
+
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		lg.Error("Failed to connect to system bus", "error", err.Error())
+		return nop
+	}
+
+	path, err := resolveSession(conn)
+	if err != nil {
+		lg.Error("Failed to resolve login session", "error", err.Error())
+		conn.Close()
+		return nop
+	}
+
+	err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface(login1SessionIface),
+	)
+	if err != nil {
+		lg.Error("Failed to add match for signal", "error", err.Error())
+		conn.Close()
+		return nop
+	}
+
+	signalChan := make(chan *dbus.Signal, 10)
+	conn.Signal(signalChan)
+
+	go func() {
+		for signal := range signalChan {
+			if signal.Path != path {
+				continue
+			}
+			switch signal.Name {
+			case login1SessionIface + ".Lock":
+				lg.Debug("got Lock from logind")
+				onLock()
+			case login1SessionIface + ".Unlock":
+				lg.Debug("got Unlock from logind")
+				onUnlock()
+			}
+		}
+	}()
+
+	lg.Debug("Watching login session", "path", path)
+	session := conn.Object(login1Name, path)
+	return func(locked bool) {
+		call := session.Call(login1SessionIface+".SetLockedHint", 0, locked)
+		if call.Err != nil {
+			lg.Error("Failed to set LockedHint", "error", call.Err.Error())
+		}
+	}
+}
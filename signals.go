@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+// goidleSignals are the signals of io.github.trbjo.GoIdle.
+var goidleSignals = []introspect.Signal{
+	{Name: "StateChanged", Args: []introspect.Arg{
+		{Name: "old", Type: "s"}, {Name: "new", Type: "s"}, {Name: "reason", Type: "s"},
+	}},
+	{Name: "Locked"},
+	{Name: "Unlocked", Args: []introspect.Arg{{Name: "method", Type: "s"}}},
+	{Name: "UnlockFailed"},
+	{Name: "Dimmed"},
+	{Name: "Undimmed"},
+	{Name: "OutputsOff"},
+	{Name: "OutputsOn"},
+	{Name: "PrepareForSleep", Args: []introspect.Arg{{Name: "start", Type: "b"}}},
+	{Name: "BrightnessChanged", Args: []introspect.Arg{{Name: "value", Type: "u"}, {Name: "max", Type: "u"}}},
+}
+
+// Signals emits the signals of an interface. Signals emitted before Export
+// are dropped.
+type Signals struct {
+	iface string
+	path  dbus.ObjectPath
+	mu    sync.Mutex
+	conn  *dbus.Conn
+}
+
+func NewSignals(iface string, path dbus.ObjectPath) *Signals {
+	return &Signals{iface: iface, path: path}
+}
+
+func (s *Signals) Export(conn *dbus.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = conn
+}
+
+func (s *Signals) Emit(name string, args ...any) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	lg.Debug("emitting signal", "signal", name)
+	if err := conn.Emit(s.path, s.iface+"."+name, args...); err != nil {
+		lg.Error("Failed to emit signal", "signal", name, "error", err.Error())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+)
+
+// takeSleepInhibitor asks logind to delay sleep until the returned file
+// descriptor is closed.
+func takeSleepInhibitor(conn *dbus.Conn) (dbus.UnixFD, bool) {
+	var fd dbus.UnixFD
+	obj := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
+	err := obj.Call("org.freedesktop.login1.Manager.Inhibit", 0,
+		"sleep", "goidle", "Lock the screen before sleep", "delay").Store(&fd)
+	if err != nil {
+		lg.Error("Failed to take sleep inhibitor", "error", err.Error())
+		return -1, false
+	}
+	lg.Debug("took sleep inhibitor")
+	return fd, true
+}
+
+// SleepWatcher makes sure the screen is locked before the system sleeps, no
+// matter who initiated it. It holds a logind delay inhibitor, runs onSleep
+// when logind announces the system is about to sleep and only then lets go of
+// the inhibitor. After resuming it takes the inhibitor again and runs
+// onResume.
+func SleepWatcher(onSleep func(), onResume func()) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		lg.Error("Failed to connect to system bus", "error", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	match := []dbus.MatchOption{
+		dbus.WithMatchInterface("org.freedesktop.login1.Manager"),
+		dbus.WithMatchMember("PrepareForSleep"),
+	}
+	if err := conn.AddMatchSignal(match...); err != nil {
+		lg.Error("Failed to add match for signal", "error", err.Error())
+		return
+	}
+
+	signalChan := make(chan *dbus.Signal, 10)
+	conn.Signal(signalChan)
+
+	fd, held := takeSleepInhibitor(conn)
+	for signal := range signalChan {
+		if signal.Name != "org.freedesktop.login1.Manager.PrepareForSleep" || len(signal.Body) == 0 {
+			continue
+		}
+		preparing, ok := signal.Body[0].(bool)
+		if !ok {
+			continue
+		}
+
+		if preparing {
+			lg.Debug("system is about to sleep")
+			onSleep()
+			if held {
+				unix.Close(int(fd))
+				held = false
+				lg.Debug("released sleep inhibitor")
+			}
+		} else {
+			lg.Debug("system resumed")
+			if !held {
+				fd, held = takeSleepInhibitor(conn)
+			}
+			onResume()
+		}
+	}
+}
@@ -3,48 +3,66 @@ package main
 import (
 	"sync"
 	"time"
-
-	"github.com/rajveermalviya/go-wayland/wayland/staging/ext-idle-notify-v1"
 )
 
+// IdleNotifier delivers idle and resume events for registered timeouts.
+// IdleManager implements it on top of ext_idle_notify_v1.
+type IdleNotifier interface {
+	// RegisterIdleTimeout returns nil if the timeout could not be registered.
+	RegisterIdleTimeout(timeout time.Duration, ignoreInhibitors bool, onIdle, onResume func()) IdleTimeout
+	UnregisterIdleTimeout(IdleTimeout)
+}
+
+// IdleTimeout is a timeout registered with an IdleNotifier.
+type IdleTimeout any
+
 type TimeoutHandler struct {
-	Notification *ext_idle_notify.IdleNotification
+	Notification IdleTimeout
 	State        StateValue
 	Timeout      time.Duration
-	OnIdle       func()
-	OnResume     func()
+	// IgnoreInhibitors makes the timeout fire on input idleness alone, even
+	// while a Wayland idle inhibitor is active.
+	IgnoreInhibitors bool
+	OnIdle           func()
+	OnResume         func()
 }
 
 type StateManager struct {
-	idleManager  *IdleManager
+	idleManager  IdleNotifier
+	clock        Clock
 	timeouts     []*TimeoutHandler
 	currentState *SafeState[StateValue]
 	mu           sync.Mutex
+	// armedAt is when the timeouts of the current state were registered
+	armedAt  time.Duration
+	onChange func(old, new StateValue, reason string)
 }
 
-func NewStateManager(idleManager *IdleManager) *StateManager {
+func NewStateManager(idleManager IdleNotifier, clock Clock) *StateManager {
 	return &StateManager{
 		idleManager:  idleManager,
+		clock:        clock,
 		timeouts:     make([]*TimeoutHandler, 0),
 		currentState: NewSafeState[StateValue](None),
 	}
 }
 
-func (sm *StateManager) RegisterTimeout(state StateValue, timeout time.Duration, onIdle, onResume func()) {
-	sm.register(state, timeout, onIdle, onResume, false)
+func (sm *StateManager) RegisterTimeout(state StateValue, timeout time.Duration, ignoreInhibitors bool, onIdle, onResume func()) *TimeoutHandler {
+	return sm.register(state, timeout, ignoreInhibitors, onIdle, onResume, false)
 }
 
-func (sm *StateManager) RegisterTimeoutOnce(state StateValue, timeout time.Duration, onIdle, onResume func()) {
-	sm.register(state, timeout, onIdle, onResume, true)
+func (sm *StateManager) RegisterTimeoutOnce(state StateValue, timeout time.Duration, onIdle, onResume func()) *TimeoutHandler {
+	return sm.register(state, timeout, false, onIdle, onResume, true)
 }
 
-func (sm *StateManager) register(state StateValue, timeout time.Duration, onIdle, onResume func(), runOnce bool) {
+func (sm *StateManager) register(state StateValue, timeout time.Duration, ignoreInhibitors bool, onIdle, onResume func(), runOnce bool) *TimeoutHandler {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 	h := &TimeoutHandler{
-		Timeout: timeout,
-		OnIdle:  onIdle,
-		State:   state,
+		Timeout:          timeout,
+		IgnoreInhibitors: ignoreInhibitors,
+		OnIdle:           onIdle,
+		State:            state,
 	}
 
 	h.OnResume = func() {
@@ -60,16 +78,77 @@ func (sm *StateManager) register(state StateValue, timeout time.Duration, onIdle
 		}
 	}
 	sm.timeouts = append(sm.timeouts, h)
+	return h
+}
+
+// Rearm restarts the timeout of a handler that already fired, so it fires
+// again after another timeout without input. Handlers of other states or
+// replaced by ReplaceTimeouts are left alone.
+func (sm *StateManager) Rearm(h *TimeoutHandler) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.currentState.Get() != h.State || h.Notification == nil {
+		return
+	}
+	sm.idleManager.UnregisterIdleTimeout(h.Notification)
+	h.Notification = sm.idleManager.RegisterIdleTimeout(h.Timeout, h.IgnoreInhibitors, h.OnIdle, h.OnResume)
+}
+
+// ReplaceTimeouts drops every registered handler, lets register install a new
+// set and arms the ones belonging to the current state, leaving the state
+// itself untouched.
+func (sm *StateManager) ReplaceTimeouts(register func()) {
+	sm.mu.Lock()
+	for _, handler := range sm.timeouts {
+		if handler.Notification != nil {
+			sm.idleManager.UnregisterIdleTimeout(handler.Notification)
+			handler.Notification = nil
+		}
+	}
+	sm.timeouts = make([]*TimeoutHandler, 0)
+	sm.mu.Unlock()
+
+	register()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, handler := range sm.timeouts {
+		if sm.currentState.Get() == handler.State {
+			handler.Notification = sm.idleManager.RegisterIdleTimeout(handler.Timeout, handler.IgnoreInhibitors, handler.OnIdle, handler.OnResume)
+		}
+	}
+	sm.armedAt = sm.clock.SinceBoot()
+	lg.Debug("Replaced timeouts", "state", sm.currentState.Get().String())
+}
+
+// ArmedAt returns the time since boot at which the timeouts of the current
+// state were last registered.
+func (sm *StateManager) ArmedAt() time.Duration {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.armedAt
 }
 
 func (sm *StateManager) ReadState() StateValue {
 	return sm.currentState.Get()
 }
 
-func (sm *StateManager) SetState(newState StateValue, duration time.Duration, stateFunc func() bool) {
-	if sm.currentState.Get() == newState {
+// OnChange sets a function called with the reason passed to SetState after it
+// changed the state. It must be set before the state is first set.
+func (sm *StateManager) OnChange(fn func(old, new StateValue, reason string)) {
+	sm.onChange = fn
+}
+
+func (sm *StateManager) SetState(newState StateValue, reason string, duration time.Duration, stateFunc func() bool) {
+	oldState := sm.currentState.Get()
+	if oldState == newState {
 		lg.Debug("state already active, resetting", "state", newState.String())
 	}
+	defer func() {
+		if current := sm.currentState.Get(); current != oldState && sm.onChange != nil {
+			sm.onChange(oldState, current, reason)
+		}
+	}()
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
@@ -88,14 +167,15 @@ func (sm *StateManager) SetState(newState StateValue, duration time.Duration, st
 		return
 	}
 
-	time.Sleep(duration)
+	sm.clock.Sleep(duration)
 
 	for _, handler := range sm.timeouts {
 		if newState == handler.State {
-			handler.Notification = sm.idleManager.RegisterIdleTimeout(handler.Timeout, handler.OnIdle, handler.OnResume)
+			handler.Notification = sm.idleManager.RegisterIdleTimeout(handler.Timeout, handler.IgnoreInhibitors, handler.OnIdle, handler.OnResume)
 		}
 	}
 
+	sm.armedAt = sm.clock.SinceBoot()
 	sm.currentState.Set(newState)
 	lg.Debug("Successfully set new state", "state", newState.String())
 
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/trbjo/goidle/dbusapi"
+)
+
+const defaultStatusTemplate = "{{.State}}"
+
+// Status is what the status stream reports and the data of its template.
+type Status struct {
+	// State is active, dimmed, idle, inhibited, locked or stopped when goidle
+	// is not running
+	State      string
+	Inhibitors []InhibitorInfo
+	// Brightness is the screen brightness in percent
+	Brightness int
+	// NextStage is the action of the next idle stage, empty if none is left
+	// or its time passed
+	NextStage string
+	// NextStageAt is the earliest time the next stage runs, input pushes it
+	// back
+	NextStageAt time.Time
+	NextStageIn time.Duration
+	Caffeine    time.Duration
+}
+
+// statusFromProperties builds the Status from the properties of the GoIdle
+// interface, no properties meaning goidle is not running.
+func statusFromProperties(props map[string]dbus.Variant, now time.Time) Status {
+	if props == nil {
+		return Status{State: "stopped"}
+	}
+	flag := func(name string) bool {
+		v, _ := props[name].Value().(bool)
+		return v
+	}
+	number := func(name string) uint32 {
+		v, _ := props[name].Value().(uint32)
+		return v
+	}
+
+	var s Status
+	switch {
+	case flag("Locked"):
+		s.State = "locked"
+	case flag("Inhibited"):
+		s.State = "inhibited"
+	case flag("OutputsOff"):
+		s.State = "idle"
+	case flag("Dimmed"):
+		s.State = "dimmed"
+	default:
+		s.State = "active"
+	}
+	if v, ok := props["Inhibitors"]; ok {
+		if err := v.Store(&s.Inhibitors); err != nil {
+			lg.Debug("Failed to read inhibitors", "error", err.Error())
+		}
+	}
+	if maxBrightness := number("MaxBrightness"); maxBrightness > 0 {
+		s.Brightness = int(math.Round(100 * float64(number("Brightness")) / float64(maxBrightness)))
+	}
+	// a passed deadline means the stage ran or input pushed it back, goidle
+	// is not told about input until the next stage is due
+	next, _ := props["NextStage"].Value().(string)
+	if at, _ := props["NextStageAt"].Value().(int64); next != "" && time.Unix(at, 0).After(now) {
+		s.NextStage = next
+		s.NextStageAt = time.Unix(at, 0)
+		s.NextStageIn = s.NextStageAt.Sub(now).Round(time.Second)
+	}
+	s.Caffeine = time.Duration(number("CaffeineRemaining")) * time.Second
+	return s
+}
+
+func (s Status) tooltip() string {
+	if s.State == "stopped" {
+		return "goidle is not running"
+	}
+	lines := []string{"goidle is " + s.State}
+	if s.Brightness > 0 {
+		lines = append(lines, fmt.Sprintf("Brightness: %d%%", s.Brightness))
+	}
+	if s.NextStage != "" {
+		lines = append(lines, fmt.Sprintf("Next: %s in %s at the earliest", s.NextStage, s.NextStageIn))
+	}
+	if s.Caffeine > 0 {
+		lines = append(lines, fmt.Sprintf("Caffeinated for %s", s.Caffeine))
+	}
+	if len(s.Inhibitors) > 0 {
+		lines = append(lines, "Inhibited by:")
+		for _, i := range s.Inhibitors {
+			line := "  " + i.App
+			if i.Reason != "" {
+				line += ": " + i.Reason
+			}
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+type waybarStatus struct {
+	Text    string `json:"text"`
+	Tooltip string `json:"tooltip"`
+	Class   string `json:"class"`
+	Alt     string `json:"alt"`
+}
+
+// formatWaybar returns the line a waybar custom module with return-type json
+// expects.
+func formatWaybar(s Status, text *template.Template) ([]byte, error) {
+	var b bytes.Buffer
+	if err := text.Execute(&b, s); err != nil {
+		return nil, err
+	}
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(waybarStatus{Text: b.String(), Tooltip: s.tooltip(), Class: s.State, Alt: s.State})
+	return line.Bytes(), err
+}
+
+// runStatusStream connects to the running daemon and prints its status every
+// time it changes, returning the process exit code.
+func runStatusStream(format, text string) int {
+	if format != "waybar" {
+		fmt.Fprintf(os.Stderr, "unsupported format %q, expected waybar\n", format)
+		return 2
+	}
+	tmpl, err := template.New("text").Parse(text)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid template:", err)
+		return 2
+	}
+
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect to session bus:", err)
+		return 1
+	}
+	err = conn.AddMatchSignal(
+		dbus.WithMatchSender(dbusapi.BusName),
+		dbus.WithMatchObjectPath(dbusPath),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+	)
+	if err == nil {
+		err = conn.AddMatchSignal(
+			dbus.WithMatchInterface("org.freedesktop.DBus"),
+			dbus.WithMatchMember("NameOwnerChanged"),
+			dbus.WithMatchArg(0, dbusapi.BusName),
+		)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to watch goidle:", err)
+		return 1
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+
+	obj := conn.Object(dbusapi.BusName, dbusPath)
+	getAll := func() map[string]dbus.Variant {
+		var props map[string]dbus.Variant
+		if err := obj.Call("org.freedesktop.DBus.Properties.GetAll", dbus.FlagNoAutoStart, dbusInterface).Store(&props); err != nil {
+			lg.Debug("Failed to read the properties", "error", err.Error())
+			return nil
+		}
+		return props
+	}
+
+	props := getAll()
+	var last []byte
+	for {
+		now := time.Now()
+		status := statusFromProperties(props, now)
+		line, err := formatWaybar(status, tmpl)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to render the status:", err)
+			return 1
+		}
+		if !bytes.Equal(line, last) {
+			os.Stdout.Write(line)
+			last = line
+		}
+
+		// counts down to the next stage, nil while none is pending
+		var tick <-chan time.Time
+		if status.NextStage != "" {
+			tick = time.After(min(status.NextStageAt.Sub(now), time.Second))
+		}
+		var sig *dbus.Signal
+		var ok bool
+		select {
+		case <-tick:
+			continue
+		case sig, ok = <-signals:
+		}
+		if !ok {
+			fmt.Fprintln(os.Stderr, "lost the connection to the session bus")
+			return 1
+		}
+		if len(sig.Body) < 3 {
+			continue
+		}
+		switch sig.Name {
+		case "org.freedesktop.DBus.NameOwnerChanged":
+			if owner, _ := sig.Body[2].(string); owner == "" {
+				props = nil
+			} else {
+				props = getAll()
+			}
+		case "org.freedesktop.DBus.Properties.PropertiesChanged":
+			if iface, _ := sig.Body[0].(string); iface != dbusInterface {
+				continue
+			}
+			if props == nil {
+				props = getAll()
+				continue
+			}
+			changed, _ := sig.Body[1].(map[string]dbus.Variant)
+			for name, value := range changed {
+				props[name] = value
+			}
+			if invalidated, _ := sig.Body[2].([]string); len(invalidated) > 0 {
+				props = getAll()
+			}
+		}
+	}
+}
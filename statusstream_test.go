@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestStatusStream(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name     string
+		props    map[string]any
+		template string
+		want     string
+	}{
+		{
+			name:     "stopped",
+			template: defaultStatusTemplate,
+			want:     `{"text":"stopped","tooltip":"goidle is not running","class":"stopped","alt":"stopped"}`,
+		},
+		{
+			name: "dimmed",
+			props: map[string]any{
+				"Dimmed":        true,
+				"Brightness":    uint32(30),
+				"MaxBrightness": uint32(120),
+				"NextStage":     "lock",
+				"NextStageAt":   now.Add(90 * time.Second).Unix(),
+			},
+			template: "{{.Brightness}}% {{.NextStage}} in {{.NextStageIn}}",
+			want:     `{"text":"25% lock in 1m30s","tooltip":"goidle is dimmed\nBrightness: 25%\nNext: lock in 1m30s at the earliest","class":"dimmed","alt":"dimmed"}`,
+		},
+		{
+			name: "locked while inhibited",
+			props: map[string]any{
+				"Locked":     true,
+				"Inhibited":  true,
+				"OutputsOff": true,
+			},
+			template: defaultStatusTemplate,
+			want:     `{"text":"locked","tooltip":"goidle is locked","class":"locked","alt":"locked"}`,
+		},
+		{
+			name: "inhibited",
+			props: map[string]any{
+				"Inhibited":  true,
+				"Inhibitors": []InhibitorInfo{{Cookie: 1, Kind: "idle", App: "mpv", Reason: "video"}},
+			},
+			template: "{{len .Inhibitors}}",
+			want:     `{"text":"1","tooltip":"goidle is inhibited\nInhibited by:\n  mpv: video","class":"inhibited","alt":"inhibited"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var props map[string]dbus.Variant
+			if tt.props != nil {
+				props = make(map[string]dbus.Variant)
+				for name, value := range tt.props {
+					props[name] = dbus.MakeVariant(value)
+				}
+			}
+			line, err := formatWaybar(statusFromProperties(props, now), template.Must(template.New("text").Parse(tt.template)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(line); got != tt.want+"\n" {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusStreamNextStagePassed(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	props := map[string]dbus.Variant{
+		"NextStage":   dbus.MakeVariant("lock"),
+		"NextStageAt": dbus.MakeVariant(now.Add(5 * time.Second).Unix()),
+	}
+	tmpl := template.Must(template.New("text").Parse("{{if .NextStage}}{{.NextStage}} in {{.NextStageIn}}{{end}}"))
+	tests := []struct {
+		at   time.Time
+		want string
+	}{
+		{now, `{"text":"lock in 5s","tooltip":"goidle is active\nNext: lock in 5s at the earliest","class":"active","alt":"active"}`},
+		{now.Add(4 * time.Second), `{"text":"lock in 1s","tooltip":"goidle is active\nNext: lock in 1s at the earliest","class":"active","alt":"active"}`},
+		// input pushed the stage back, goidle sends nothing until it is due
+		{now.Add(5 * time.Second), `{"text":"","tooltip":"goidle is active","class":"active","alt":"active"}`},
+		{now.Add(time.Minute), `{"text":"","tooltip":"goidle is active","class":"active","alt":"active"}`},
+	}
+	for _, tt := range tests {
+		line, err := formatWaybar(statusFromProperties(props, tt.at), tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(line); got != tt.want+"\n" {
+			t.Errorf("%s after the update: got %s, want %s", tt.at.Sub(now), got, tt.want)
+		}
+	}
+}
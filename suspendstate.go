@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"github.com/godbus/dbus/v5"
+	"os"
 	"os/exec"
+	"strconv"
+	"time"
 )
 
 func CreateCustomSuspendFunc(lidClosedChecker func() bool, SuspendCommand []string) func() bool {
@@ -27,68 +31,230 @@ func CreateCustomSuspendFunc(lidClosedChecker func() bool, SuspendCommand []stri
 	}
 }
 
-func CreateSuspendFunc(lidClosedChecker func() bool, customSuspendCommand []string) func() bool {
-	if len(customSuspendCommand) > 0 {
-		return CreateCustomSuspendFunc(lidClosedChecker, customSuspendCommand)
+const (
+	SleepModeSuspend              = "suspend"
+	SleepModeHibernate            = "hibernate"
+	SleepModeHybridSleep          = "hybrid-sleep"
+	SleepModeSuspendThenHibernate = "suspend-then-hibernate"
+)
+
+var sleepModes = []string{SleepModeSuspend, SleepModeHibernate, SleepModeHybridSleep, SleepModeSuspendThenHibernate}
+
+const rtcWakeAlarmPath = "/sys/class/rtc/rtc0/wakealarm"
+
+func CreateSuspendFunc(lidClosedChecker func() bool, config *Config) func() bool {
+	if len(config.SuspendCommand) > 0 {
+		return CreateCustomSuspendFunc(lidClosedChecker, config.SuspendCommand)
+	}
+	switch config.SleepMode {
+	case SleepModeHibernate:
+		return CreateSystemdSleepFunc(lidClosedChecker, "Hibernate")
+	case SleepModeHybridSleep:
+		return CreateSystemdSleepFunc(lidClosedChecker, "HybridSleep")
+	case SleepModeSuspendThenHibernate:
+		return CreateSuspendThenHibernateFunc(lidClosedChecker, config.HibernateAfter.Duration)
+	default:
+		return CreateSystemdSuspendFunc(lidClosedChecker)
 	}
-	return CreateSystemdSuspendFunc(lidClosedChecker)
 }
 
 func CreateSystemdSuspendFunc(lidClosedChecker func() bool) func() bool {
+	return CreateSystemdSleepFunc(lidClosedChecker, "Suspend")
+}
+
+// CreateSystemdSleepFunc returns a function that puts the system to sleep
+// through the named org.freedesktop.login1.Manager method (Suspend,
+// Hibernate, HybridSleep, ...) and blocks until the system has resumed with
+// the lid open.
+func CreateSystemdSleepFunc(lidClosedChecker func() bool, method string) func() bool {
+	return func() bool {
+		lg.Info("Entering systemd sleep", "method", method)
+		return withLogind(func(conn *dbus.Conn, signalChan <-chan *dbus.Signal) bool {
+			for {
+				if !logindSleep(conn, signalChan, method) {
+					return false
+				}
+				if lidClosedChecker() {
+					lg.Info("Lid is still closed, sleeping again")
+					continue
+				}
+				lg.Info("Exiting sleep")
+				return true
+			}
+		})
+	}
+}
+
+// CreateSuspendThenHibernateFunc uses logind's SuspendThenHibernate where it
+// is supported. Otherwise goidle sets an RTC wake alarm hibernateAfter from
+// now, suspends, and hibernates if it was the alarm that woke the system.
+func CreateSuspendThenHibernateFunc(lidClosedChecker func() bool, hibernateAfter time.Duration) func() bool {
 	return func() bool {
-		lg.Info("Entering systemd suspend")
+		lg.Info("Entering suspend-then-hibernate", "hibernate_after", hibernateAfter.String())
+		return withLogind(func(conn *dbus.Conn, signalChan <-chan *dbus.Signal) bool {
+			method := "Suspend"
+			if logindCan(conn, "CanSuspendThenHibernate") {
+				method = "SuspendThenHibernate"
+			} else {
+				lg.Info("logind can't suspend-then-hibernate, using an RTC wake alarm")
+			}
+
+			deadline := time.Now().Add(hibernateAfter).Unix()
+			for {
+				useAlarm := method == "Suspend"
+				if useAlarm {
+					if err := setWakeAlarm(deadline); err != nil {
+						lg.Error("Failed to set RTC wake alarm, suspending without hibernation", "error", err.Error())
+						useAlarm = false
+					}
+				}
+
+				slept := logindSleep(conn, signalChan, method)
+				if useAlarm {
+					clearWakeAlarm()
+				}
+				if !slept {
+					return false
+				}
+
+				// the wall clock keeps counting while suspended, unlike Go's
+				// monotonic clock
+				if useAlarm && time.Now().Unix() >= deadline {
+					lg.Info("Woken by the RTC wake alarm, hibernating")
+					method = "Hibernate"
+					continue
+				}
+
+				if lidClosedChecker() {
+					lg.Info("Lid is still closed, sleeping again")
+					continue
+				}
+				lg.Info("Exiting sleep")
+				return true
+			}
+		})
+	}
+}
 
+// checkSuspendThenHibernate returns an error unless logind can
+// suspend-then-hibernate or goidle can set the RTC wake alarm.
+func checkSuspendThenHibernate() error {
+	return suspendThenHibernateSupport(func() bool {
 		conn, err := dbus.ConnectSystemBus()
 		if err != nil {
-			lg.Error("Failed to connect to system bus", "error", err.Error())
+			lg.Debug("Failed to connect to system bus", "error", err.Error())
 			return false
 		}
 		defer conn.Close()
+		return logindCan(conn, "CanSuspendThenHibernate")
+	}, rtcWakeAlarmPath)
+}
 
-		// Set up signal matching
-		match := dbus.WithMatchInterface("org.freedesktop.login1.Manager")
-		err = conn.AddMatchSignal(match)
-		if err != nil {
-			lg.Error("Failed to add match for signal", "error", err.Error())
-			return false
-		}
+func suspendThenHibernateSupport(logindCanSuspendThenHibernate func() bool, wakeAlarmPath string) error {
+	if logindCanSuspendThenHibernate() {
+		return nil
+	}
+	// only root can write the wake alarm on most systems
+	f, err := os.OpenFile(wakeAlarmPath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("logind can't suspend-then-hibernate and the RTC wake alarm is not writable: %w", err)
+	}
+	return f.Close()
+}
 
-		signalChan := make(chan *dbus.Signal, 10)
-		conn.Signal(signalChan)
+func setWakeAlarm(unixTime int64) error {
+	// the kernel refuses a new alarm while one is set
+	if err := os.WriteFile(rtcWakeAlarmPath, []byte("0"), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(rtcWakeAlarmPath, []byte(strconv.FormatInt(unixTime, 10)), 0644)
+}
 
-		defer func() {
-			conn.RemoveSignal(signalChan)
-			conn.RemoveMatchSignal(match)
-		}()
+func clearWakeAlarm() {
+	if err := os.WriteFile(rtcWakeAlarmPath, []byte("0"), 0644); err != nil {
+		lg.Error("Failed to clear RTC wake alarm", "error", err.Error())
+	}
+}
 
-		for {
-			// Trigger suspend
-			obj := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
-			call := obj.Call("org.freedesktop.login1.Manager.Suspend", 0, false)
-			if call.Err != nil {
-				lg.Error("Failed to suspend via DBus", "error", call.Err.Error())
-				return false
-			}
+// withLogind connects to the system bus and passes fn a channel with the
+// signals of the login1 manager.
+func withLogind(fn func(conn *dbus.Conn, signalChan <-chan *dbus.Signal) bool) bool {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		lg.Error("Failed to connect to system bus", "error", err.Error())
+		return false
+	}
+	defer conn.Close()
 
-			// Wait for the suspension to complete
-			for {
-				select {
-				case signal := <-signalChan:
-					if signal.Name == "org.freedesktop.login1.Manager.PrepareForSleep" {
-						preparing := signal.Body[0].(bool)
-						if !preparing {
-							lg.Info("System has resumed from suspend")
-							if lidClosedChecker() {
-								lg.Info("Lid is still closed, suspending again")
-								break
-							} else {
-								lg.Info("Exiting suspend")
-								return true
-							}
-						}
-					}
-				}
-			}
+	// Set up signal matching
+	match := dbus.WithMatchInterface("org.freedesktop.login1.Manager")
+	err = conn.AddMatchSignal(match)
+	if err != nil {
+		lg.Error("Failed to add match for signal", "error", err.Error())
+		return false
+	}
+
+	signalChan := make(chan *dbus.Signal, 10)
+	conn.Signal(signalChan)
+
+	defer func() {
+		conn.RemoveSignal(signalChan)
+		conn.RemoveMatchSignal(match)
+	}()
+
+	return fn(conn, signalChan)
+}
+
+func logindCan(conn *dbus.Conn, method string) bool {
+	var answer string
+	obj := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
+	if err := obj.Call("org.freedesktop.login1.Manager."+method, 0).Store(&answer); err != nil {
+		lg.Debug("logind capability check failed", "method", method, "error", err.Error())
+		return false
+	}
+	return answer == "yes"
+}
+
+// logindSleep calls method on the login1 manager and blocks until logind
+// announces that the system has resumed.
+func logindSleep(conn *dbus.Conn, signalChan <-chan *dbus.Signal, method string) bool {
+	obj := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
+	call := obj.Call("org.freedesktop.login1.Manager."+method, 0, false)
+	if call.Err != nil {
+		lg.Error("Failed to sleep via DBus", "method", method, "error", call.Err.Error())
+		return false
+	}
+
+	// Wait for the sleep to complete
+	for signal := range signalChan {
+		if signal.Name != "org.freedesktop.login1.Manager.PrepareForSleep" || len(signal.Body) == 0 {
+			continue
+		}
+		if preparing, ok := signal.Body[0].(bool); ok && !preparing {
+			lg.Info("System has resumed from sleep", "method", method)
+			return true
+		}
+	}
+	return false
+}
+
+func CreateSystemdPowerOffFunc() func() bool {
+	return func() bool {
+		lg.Info("Powering off through systemd")
+
+		conn, err := dbus.ConnectSystemBus()
+		if err != nil {
+			lg.Error("Failed to connect to system bus", "error", err.Error())
+			return false
+		}
+		defer conn.Close()
+
+		obj := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
+		call := obj.Call("org.freedesktop.login1.Manager.PowerOff", 0, false)
+		if call.Err != nil {
+			lg.Error("Failed to power off via DBus", "error", call.Err.Error())
+			return false
 		}
+		return true
 	}
 }
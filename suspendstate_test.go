@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSuspendThenHibernateSupport(t *testing.T) {
+	dir := t.TempDir()
+	writable := filepath.Join(dir, "wakealarm")
+	if err := os.WriteFile(writable, []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name      string
+		logind    bool
+		wakeAlarm string
+		wantErr   bool
+	}{
+		{name: "logind", logind: true, wakeAlarm: missing},
+		{name: "wake alarm", logind: false, wakeAlarm: writable},
+		{name: "neither", logind: false, wakeAlarm: missing, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := suspendThenHibernateSupport(func() bool { return tt.logind }, tt.wakeAlarm)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("suspendThenHibernateSupport returned %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+	if data, _ := os.ReadFile(writable); string(data) != "0" {
+		t.Errorf("the check wrote %q to the wake alarm", data)
+	}
+}
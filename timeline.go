@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Stage is one step of the timeline: after Timeout without input in its
+// state, Action runs, and Resume runs on the next input.
+type Stage struct {
+	Timeout Duration `json:"timeout"`
+	Action  Action   `json:"action"`
+	Resume  Action   `json:"resume"`
+	// When lists conditions that must all hold for Action to run. A condition
+	// prefixed with ! must not hold.
+	When             []string `json:"when"`
+	IgnoreInhibitors bool     `json:"ignore_inhibitors"`
+}
+
+// Timeline holds the stages of the Active state, before the screen is
+// locked, and of the Idle state, after it is locked.
+type Timeline struct {
+	Active []Stage `json:"active"`
+	Idle   []Stage `json:"idle"`
+}
+
+const (
+	ActionDim                  = "dim"
+	ActionUndim                = "undim"
+	ActionLock                 = "lock"
+	ActionUnlock               = "unlock"
+	ActionOutputsOff           = "outputs_off"
+	ActionOutputsOn            = "outputs_on"
+	ActionSuspend              = "suspend"
+	ActionHibernate            = "hibernate"
+	ActionHybridSleep          = "hybrid_sleep"
+	ActionKeyboardBacklightOff = "keyboard_backlight_off"
+	ActionKeyboardBacklightOn  = "keyboard_backlight_on"
+)
+
+var stageActions = []string{
+	ActionDim, ActionUndim, ActionLock, ActionUnlock, ActionOutputsOff, ActionOutputsOn,
+	ActionSuspend, ActionHibernate, ActionHybridSleep, ActionKeyboardBacklightOff, ActionKeyboardBacklightOn,
+}
+
+const (
+	ConditionOnBattery    = "on_battery"
+	ConditionSingleOutput = "single_output"
+	ConditionLidClosed    = "lid_closed"
+)
+
+var stageConditions = []string{ConditionOnBattery, ConditionSingleOutput, ConditionLidClosed}
+
+// StageEvent is sent when a stage's timeout passes or, with Resumed, when
+// input follows. Index is the stage's position in the timeline of State, or
+// -1 for the unlock probe every Idle state starts with.
+type StageEvent struct {
+	State   StateValue
+	Index   int
+	Resumed bool
+
+	handler *TimeoutHandler
+}
+
+// unlockProbe tries to unlock on the first input after the screen locked, so
+// input within the grace period unlocks right away.
+var unlockProbe = Stage{
+	Timeout: Duration{Duration: 30 * time.Millisecond},
+	Resume:  Action{Name: ActionUnlock},
+}
+
+// EffectiveTimeline returns the configured timeline, or one built from the
+// timeout_* settings when there is none.
+func (c *Config) EffectiveTimeline() Timeline {
+	if c.Timeline != nil {
+		return *c.Timeline
+	}
+	return Timeline{
+		Active: []Stage{
+			{
+				Timeout:          c.TimeoutActiveDim,
+				Action:           Action{Name: ActionDim},
+				Resume:           Action{Name: ActionUndim},
+				IgnoreInhibitors: c.ignoresInhibitors("timeout_active_dim"),
+			},
+			{
+				Timeout:          c.TimeoutActiveToIdle,
+				Action:           Action{Name: ActionLock},
+				IgnoreInhibitors: c.ignoresInhibitors("timeout_active_to_idle"),
+			},
+		},
+		Idle: []Stage{
+			{
+				Timeout:          c.TimeoutIdleBacklightOff,
+				Action:           Action{Name: ActionOutputsOff},
+				Resume:           Action{Name: ActionUnlock},
+				IgnoreInhibitors: c.ignoresInhibitors("timeout_idle_backlight_off"),
+			},
+			{
+				Timeout: c.TimeoutIdleToSuspend,
+				Action:  Action{Name: ActionSuspend},
+				// on AC or with an external monitor the laptop stays awake,
+				// the stage is retried when this changes
+				When:             []string{ConditionSingleOutput, ConditionOnBattery},
+				IgnoreInhibitors: c.ignoresInhibitors("timeout_idle_to_suspend"),
+			},
+		},
+	}
+}
+
+// Stage returns the stage an event refers to.
+func (t Timeline) Stage(state StateValue, index int) (Stage, bool) {
+	if index == -1 && state == Idle {
+		return unlockProbe, true
+	}
+	stages := t.Active
+	if state == Idle {
+		stages = t.Idle
+	}
+	if index < 0 || index >= len(stages) {
+		return Stage{}, false
+	}
+	return stages[index], true
+}
+
+// conditionsMet reports whether all conditions hold, looking each one up with
+// check.
+func conditionsMet(conditions []string, check func(condition string) bool) bool {
+	for _, condition := range conditions {
+		negate := strings.HasPrefix(condition, "!")
+		if check(strings.TrimPrefix(condition, "!")) == negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (t Timeline) validate(fail func(key, format string, args ...any)) {
+	validateStages := func(name string, stages []Stage) {
+		for i, stage := range stages {
+			key := fmt.Sprintf("timeline.%s[%d]", name, i)
+			if stage.Timeout.Duration <= 0 {
+				fail(key+".timeout", "must be positive, got %s", stage.Timeout.Duration)
+			}
+			if !stage.Action.IsSet() && !stage.Resume.IsSet() {
+				fail(key, "needs an action or a resume action")
+			}
+			validateAction(fail, key+".action", stage.Action)
+			validateAction(fail, key+".resume", stage.Resume)
+			if stage.Action.Name == ActionLock && name == "idle" {
+				fail(key+".action", "lock is only valid in the active state")
+			}
+			if stage.Action.Name == ActionUnlock {
+				fail(key+".action", "unlock is only valid as a resume action")
+			}
+			for _, condition := range stage.When {
+				if !slices.Contains(stageConditions, strings.TrimPrefix(condition, "!")) {
+					fail(key+".when", "unknown condition %q, must be one of %s", condition, strings.Join(stageConditions, ", "))
+				}
+			}
+		}
+	}
+	validateStages("active", t.Active)
+	validateStages("idle", t.Idle)
+}
+
+func validateAction(fail func(key, format string, args ...any), key string, action Action) {
+	if len(action.Command) > 0 {
+		if _, err := exec.LookPath(action.Command[0]); err != nil {
+			fail(key, "%s not found in PATH", action.Command[0])
+		}
+	} else if action.Name != "" && !slices.Contains(stageActions, action.Name) {
+		fail(key, "unknown action %q, must be one of %s or a command", action.Name, strings.Join(stageActions, ", "))
+	}
+}
+
+// runStageCommand runs the command of a stage in the background.
+func runStageCommand(action Action) {
+	go func() {
+		lg.Debug("running stage command", "command", action.String())
+		output, err := exec.Command(action.Command[0], action.Command[1:]...).CombinedOutput()
+		if err != nil {
+			lg.Error("Stage command failed", "command", action.String(), "error", err.Error(),
+				"output", strings.TrimSpace(string(output)))
+		}
+	}()
+}
@@ -73,21 +73,40 @@ func CreateLidChecker() func() bool {
 	}
 }
 
-func OnBattery() bool {
-	path := "/sys/class/power_supply/"
-	files, err := os.ReadDir(path)
+// WriteFileAtomic replaces the file at path with data so that readers either
+// see the old or the new content, never a truncated file: the data is written
+// to a temporary file in the same directory, synced and renamed into place.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
 	if err != nil {
-		return false
+		return err
 	}
+	defer os.Remove(tmp.Name())
 
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), "AC") {
-			data, err := os.ReadFile(filepath.Join(path, file.Name(), "online"))
-			if err != nil {
-				return false
-			}
-			return strings.TrimSpace(string(data)) == "0"
-		}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
-	return false
+	defer d.Close()
+	return d.Sync()
 }
@@ -0,0 +1,43 @@
+package utilities
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, []byte("old content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(path, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new" {
+		t.Errorf("read %q, %v after replacing, want new", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	// renaming over a directory fails after the temporary file was written
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.Mkdir(blocked, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(blocked, []byte("new"), 0600); err == nil {
+		t.Error("replacing a directory succeeded")
+	}
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "state.json"), []byte("new"), 0600); err == nil {
+		t.Error("writing to a missing directory succeeded")
+	}
+
+	for _, pattern := range []string{".state.json.*", ".blocked.*"} {
+		if tmp, _ := filepath.Glob(filepath.Join(dir, pattern)); len(tmp) > 0 {
+			t.Errorf("temporary files left behind: %q", tmp)
+		}
+	}
+}